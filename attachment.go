@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	attachmentCheckOff  = "off"
+	attachmentCheckFail = "fail"
+	attachmentCheckWait = "wait"
+)
+
+// Attachment checks that target groups are attached to an active load
+// balancer, targets of detached target groups stay unused and never get in
+// service
+type Attachment struct {
+	Check    string        `desc:"What to do when target group isn't attached to an active load balancer: wait for the attachment before registering, fail at startup or off. Skipped when not waiting for target to be in service or when unused counts as in service"`
+	Timeout  time.Duration `desc:"How long to wait for target group to be attached to an active load balancer"`
+	Interval time.Duration `desc:"How often to check whether target group is attached to an active load balancer"`
+}
+
+func (a *Attachment) Validate() error {
+	switch a.Check {
+	case attachmentCheckOff, attachmentCheckFail, attachmentCheckWait:
+		return nil
+	}
+	return fmt.Errorf("unsupported attachment check %q, expected %q, %q or %q", a.Check, attachmentCheckOff, attachmentCheckFail, attachmentCheckWait)
+}
+
+// attachmentRequired reports whether the target has to reach a state which
+// detached target groups never report
+func attachmentRequired(app *App) bool {
+	if app.Attachment.Check == attachmentCheckOff || !app.WaitInService {
+		return false
+	}
+	for _, state := range app.WaitInServiceStates {
+		if state == elbv2.TargetHealthStateEnumUnused {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAttachments is run after discovery, it fails when a target group
+// isn't attached and the attachment check doesn't wait for it
+func checkAttachments(app *App, bindings Bindings, registratorService *RegistratorService, logger log.Logger) error {
+	if !attachmentRequired(app) {
+		return nil
+	}
+
+	for _, binding := range bindings {
+		if binding.TargetGroup == nil {
+			continue
+		}
+		reason, err := detachedReason(binding.TargetGroup, registratorService)
+		if err != nil && isAccessError(err) {
+			level.Warn(log.With(logger, binding.LogContext()...)).Log("msg", "Unable to describe load balancers, skipping attachment check", "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("checking load balancers of target group %s: %v", binding.TargetGroupArn, err)
+		}
+		if reason == "" {
+			continue
+		}
+		if app.Attachment.Check == attachmentCheckFail {
+			return fmt.Errorf("target group %s %s, targets would stay unused", binding.TargetGroupArn, reason)
+		}
+		level.Warn(log.With(logger, binding.LogContext()...)).Log("msg", "Target group "+reason+", waiting for it before registering")
+	}
+	return nil
+}
+
+// waitAttachments waits until all target groups are attached to an active
+// load balancer
+func waitAttachments(ctx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, logger log.Logger) error {
+	if !attachmentRequired(app) || app.Attachment.Check != attachmentCheckWait {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, app.Attachment.Timeout)
+	defer cancel()
+
+	for _, binding := range bindings {
+		if binding.TargetGroup == nil {
+			continue
+		}
+		logger := log.With(logger, binding.LogContext()...)
+		targetGroup := binding.TargetGroup
+		started := time.Now()
+		for {
+			reason, err := detachedReason(targetGroup, registratorService)
+			if err != nil && isAccessError(err) {
+				level.Warn(logger).Log("msg", "Unable to describe load balancers, skipping attachment check", "error", err)
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if reason == "" {
+				break
+			}
+			logger.Log("msg", "Waiting for target group to be attached to an active load balancer", "reason", reason, "elapsed", time.Since(started).Round(time.Second))
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("target group %s %s after %s", binding.TargetGroupArn, reason, app.Attachment.Timeout)
+			case <-time.After(app.Attachment.Interval):
+			}
+
+			if targetGroup, err = registratorService.DescribeTargetGroup(binding.TargetGroupArn); err != nil {
+				return err
+			}
+		}
+		binding.TargetGroup = targetGroup
+	}
+	return nil
+}
+
+// detachedReason explains why the target group isn't attached to an active
+// load balancer, it's empty when it is
+func detachedReason(targetGroup *elbv2.TargetGroup, registratorService *RegistratorService) (string, error) {
+	if len(targetGroup.LoadBalancerArns) == 0 {
+		return "isn't used by any load balancer listener", nil
+	}
+
+	loadBalancers, err := registratorService.DescribeLoadBalancers(targetGroup.LoadBalancerArns)
+	if err != nil {
+		return "", err
+	}
+
+	var states []string
+	for _, loadBalancer := range loadBalancers {
+		if loadBalancer.State == nil {
+			continue
+		}
+		switch code := aws.StringValue(loadBalancer.State.Code); code {
+		case elbv2.LoadBalancerStateEnumActive, elbv2.LoadBalancerStateEnumActiveImpaired:
+			return "", nil
+		default:
+			states = append(states, fmt.Sprintf("%s is %s", aws.StringValue(loadBalancer.LoadBalancerName), code))
+		}
+	}
+	return "has no active load balancer, " + strings.Join(states, ", "), nil
+}
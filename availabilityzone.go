@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// availabilityZoneAll registers targets outside of the target group VPC,
+	// e.g. in a peered VPC or on-premises
+	availabilityZoneAll = "all"
+	// availabilityZoneAuto sets availabilityZoneAll only for targets outside
+	// of the target group VPC CIDRs
+	availabilityZoneAuto = "auto"
+)
+
+// VPCService looks up CIDR blocks of VPCs
+type VPCService struct {
+	EC2Client ec2iface.EC2API
+
+	mu    sync.Mutex
+	cidrs map[string][]*net.IPNet
+}
+
+func NewVPCService(ec2Client ec2iface.EC2API) *VPCService {
+	return &VPCService{EC2Client: ec2Client, cidrs: map[string][]*net.IPNet{}}
+}
+
+// CIDRs returns associated IPv4 and IPv6 CIDR blocks of the VPC
+func (v *VPCService) CIDRs(ctx context.Context, vpcID string) ([]*net.IPNet, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if cidrs, ok := v.cidrs[vpcID]; ok {
+		return cidrs, nil
+	}
+
+	out, err := v.EC2Client.DescribeVpcsWithContext(ctx, &ec2.DescribeVpcsInput{
+		VpcIds: []*string{aws.String(vpcID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Vpcs) != 1 {
+		return nil, fmt.Errorf("Unexpected count of VPCs %d", len(out.Vpcs))
+	}
+
+	var blocks []string
+	vpc := out.Vpcs[0]
+	for _, association := range vpc.CidrBlockAssociationSet {
+		if association.CidrBlockState != nil && aws.StringValue(association.CidrBlockState.State) == ec2.VpcCidrBlockStateCodeAssociated {
+			blocks = append(blocks, aws.StringValue(association.CidrBlock))
+		}
+	}
+	for _, association := range vpc.Ipv6CidrBlockAssociationSet {
+		if association.Ipv6CidrBlockState != nil && aws.StringValue(association.Ipv6CidrBlockState.State) == ec2.VpcCidrBlockStateCodeAssociated {
+			blocks = append(blocks, aws.StringValue(association.Ipv6CidrBlock))
+		}
+	}
+	if len(blocks) == 0 && vpc.CidrBlock != nil {
+		blocks = append(blocks, aws.StringValue(vpc.CidrBlock))
+	}
+
+	cidrs := make([]*net.IPNet, 0, len(blocks))
+	for _, block := range blocks {
+		_, cidr, err := net.ParseCIDR(block)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	v.cidrs[vpcID] = cidrs
+	return cidrs, nil
+}
+
+// resolveAvailabilityZones sets availability zone of every binding. With
+// availabilityZoneAuto targets outside of the target group VPC get
+// availabilityZoneAll, targets inside of it keep the zone empty so the load
+// balancer picks it.
+func resolveAvailabilityZones(ctx context.Context, app *App, bindings Bindings, vpcService *VPCService, logger log.Logger) error {
+	if app.AvailabilityZone == "" || app.TargetType != elbv2.TargetTypeEnumIp {
+		return nil
+	}
+
+	for _, binding := range bindings {
+		if app.AvailabilityZone != availabilityZoneAuto {
+			binding.AvailabilityZone = app.AvailabilityZone
+			continue
+		}
+
+		if binding.TargetGroup == nil {
+			return fmt.Errorf("target group %s couldn't be described, availability zone can't be detected, please set it explicitly", binding.TargetGroupArn)
+		}
+
+		vpcID := aws.StringValue(binding.TargetGroup.VpcId)
+		cidrs, err := vpcService.CIDRs(ctx, vpcID)
+		if err != nil {
+			return fmt.Errorf("describing VPC %s: %v", vpcID, err)
+		}
+
+		if !containsIP(cidrs, net.ParseIP(binding.TargetID)) {
+			binding.AvailabilityZone = availabilityZoneAll
+			log.With(logger, binding.LogContext()...).Log("msg", "Target is outside of the target group VPC", "vpc_id", vpcID)
+		}
+	}
+	return nil
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// Kubernetes IANA_SVC_NAME, used for named container ports
+var portNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+var targetGroupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+const maxTargetGroupNameLength = 32
+
+const (
+	tagsBindingPrefix     = "tags:"
+	listenerBindingPrefix = "lb:"
+)
+
+// Binding describes a single target group the target is registered in.
+// A target group is referenced either by name, by ARN, by tags or by
+// load balancer listener, when the ARN is known discovery is skipped.
+// Tag values are templates rendered with pod metadata.
+// Port is either given as a number or as a named container port which is
+// resolved with ResolvePort.
+type Binding struct {
+	TargetGroupName string
+	TargetGroupArn  string
+	TargetGroupTags map[string]string
+	Listener        *Listener
+	PortName        string
+	Port            *int64
+	// TargetGroup is set by discovery, it stays nil when the target group
+	// given by ARN can't be described. The reconcile loop replaces it and
+	// TargetGroupArn in Lifecycle.Do while the target is in service.
+	TargetGroup *elbv2.TargetGroup
+	// Discovered is set when the target group wasn't given by ARN and can
+	// be discovered again
+	Discovered    bool
+	IPAddressType string
+	// TargetID is the instance ID or the pod IP matching IPAddressType
+	TargetID         string
+	AvailabilityZone string
+}
+
+// Listener references a load balancer listener whose default action
+// forwards to the target group
+type Listener struct {
+	LoadBalancerName string
+	Port             int64
+}
+
+// ParseListener parses listener in a form of <load-balancer-name>:<port>
+func ParseListener(value string) (*Listener, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid listener %q, expected <load-balancer-name>:<port>", value)
+	}
+	port, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("listener %q has invalid port %q", value, parts[1])
+	}
+	return &Listener{LoadBalancerName: parts[0], Port: port}, nil
+}
+
+func (l *Listener) String() string {
+	return fmt.Sprintf("%s:%d", l.LoadBalancerName, l.Port)
+}
+
+// ParseBinding parses binding in a form of
+// <name|arn|tags:key=value,...|lb:load-balancer-name:listener-port>[:port],
+// port is either a number or a named container port, tag bindings only take
+// port numbers
+func ParseBinding(value string) (*Binding, error) {
+	if value == "" {
+		return nil, fmt.Errorf("binding is empty")
+	}
+
+	b := &Binding{}
+	var port string
+	switch {
+	case strings.HasPrefix(value, "arn:"):
+		// arn:partition:service:region:account-id:resource[:port]
+		parts := strings.SplitN(value, ":", 7)
+		if len(parts) < 6 {
+			return nil, fmt.Errorf("binding %q is not a valid target group ARN", value)
+		}
+		b.TargetGroupArn = strings.Join(parts[:6], ":")
+		if len(parts) == 7 {
+			port = parts[6]
+		}
+	case strings.HasPrefix(value, tagsBindingPrefix):
+		selector := strings.TrimPrefix(value, tagsBindingPrefix)
+		// Tag values may contain colons as well, so only a numeric last
+		// part is taken as the port. Named ports are ambiguous here, they
+		// can be given with -target-port.
+		if i := strings.LastIndex(selector, ":"); i >= 0 && isPortNumber(selector[i+1:]) {
+			selector, port = selector[:i], selector[i+1:]
+		}
+		tags, err := ParseTagSelector(strings.Split(selector, ","))
+		if err != nil {
+			return nil, fmt.Errorf("binding %q: %v", value, err)
+		}
+		b.TargetGroupTags = tags
+	case strings.HasPrefix(value, listenerBindingPrefix):
+		ref := strings.TrimPrefix(value, listenerBindingPrefix)
+		if parts := strings.SplitN(ref, ":", 3); len(parts) == 3 {
+			ref, port = parts[0]+":"+parts[1], parts[2]
+		}
+		listener, err := ParseListener(ref)
+		if err != nil {
+			return nil, fmt.Errorf("binding %q: %v", value, err)
+		}
+		b.Listener = listener
+	default:
+		parts := strings.SplitN(value, ":", 2)
+		b.TargetGroupName = parts[0]
+		if len(parts) == 2 {
+			port = parts[1]
+		}
+		if b.TargetGroupName == "" {
+			return nil, fmt.Errorf("binding %q has no target group", value)
+		}
+	}
+
+	if port != "" {
+		var err error
+		b.Port, b.PortName, err = ParsePort(port)
+		if err != nil {
+			return nil, fmt.Errorf("binding %q: %v", value, err)
+		}
+	}
+
+	return b, nil
+}
+
+func isPortNumber(value string) bool {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil
+}
+
+// ParseTagSelector parses key=value pairs into tag selector
+func ParseTagSelector(pairs []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag selector %q, expected key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("tag selector is empty")
+	}
+	return tags, nil
+}
+
+// FormatTagSelector formats tags as sorted key=value pairs
+func FormatTagSelector(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Render renders target group name and tag selector templates with pod
+// metadata
+func (b *Binding) Render(metadata *PodMetadata) error {
+	if b.TargetGroupName != "" {
+		name, err := RenderTemplate(b.TargetGroupName, metadata)
+		if err != nil {
+			return fmt.Errorf("rendering target group name: %v", err)
+		}
+		if err := ValidateTargetGroupName(name); err != nil {
+			return err
+		}
+		b.TargetGroupName = name
+	}
+
+	for key, value := range b.TargetGroupTags {
+		rendered, err := RenderTemplate(value, metadata)
+		if err != nil {
+			return fmt.Errorf("rendering value of tag %q: %v", key, err)
+		}
+		b.TargetGroupTags[key] = rendered
+	}
+	return nil
+}
+
+// ValidateTargetGroupName checks AWS constraints of target group names, so
+// a badly rendered name fails early instead of in DescribeTargetGroups
+func ValidateTargetGroupName(name string) error {
+	if len(name) > maxTargetGroupNameLength {
+		return fmt.Errorf("target group name %q is longer than %d characters, use trunc, hash or shorten template functions", name, maxTargetGroupNameLength)
+	}
+	if !targetGroupNameRegexp.MatchString(name) {
+		return fmt.Errorf("target group name %q may only contain alphanumeric characters and hyphens and can't begin or end with a hyphen", name)
+	}
+	return nil
+}
+
+// ResolvePort resolves the named port of the binding. Bindings without any
+// port get defaultPort, which is in the same format as the binding port.
+func (b *Binding) ResolvePort(defaultPort string, namedPorts NamedPorts) error {
+	if b.Port != nil {
+		return nil
+	}
+
+	if b.PortName == "" && defaultPort != "" {
+		var err error
+		b.Port, b.PortName, err = ParsePort(defaultPort)
+		if err != nil {
+			return err
+		}
+		if b.Port != nil {
+			return nil
+		}
+	}
+
+	if b.PortName == "" {
+		// Target group port is used
+		return nil
+	}
+
+	port, ok := namedPorts[b.PortName]
+	if !ok {
+		return fmt.Errorf("named port %q is not defined, please set the %s%s pod annotation", b.PortName, constants.NamedPortAnnotationPrefix, b.PortName)
+	}
+	b.Port = aws.Int64(port)
+	return nil
+}
+
+// ParsePort parses either port number or named container port
+func ParsePort(value string) (*int64, string, error) {
+	if p, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if p < 1 || p > 65535 {
+			return nil, "", fmt.Errorf("port %d is out of range", p)
+		}
+		return aws.Int64(p), "", nil
+	}
+
+	if !portNameRegexp.MatchString(value) || len(value) > 15 {
+		return nil, "", fmt.Errorf("invalid port %q", value)
+	}
+	return nil, value, nil
+}
+
+// LogContext returns key/values identifying the binding in logs
+func (b *Binding) LogContext() []interface{} {
+	keyvals := []interface{}{constants.TargetGroupArn, b.TargetGroupArn}
+	if b.TargetID != "" {
+		keyvals = append(keyvals, constants.TargetID, b.TargetID)
+	}
+	if b.TargetGroupName != "" {
+		keyvals = append(keyvals, constants.TargetGroupName, b.TargetGroupName)
+	}
+	if b.AvailabilityZone != "" {
+		keyvals = append(keyvals, constants.AvailabilityZone, b.AvailabilityZone)
+	}
+	if b.Port != nil {
+		keyvals = append(keyvals, constants.Port, aws.Int64Value(b.Port))
+	}
+	return keyvals
+}
+
+func (b *Binding) String() string {
+	ref := b.TargetGroupArn
+	switch {
+	case ref != "":
+	case b.TargetGroupTags != nil:
+		ref = tagsBindingPrefix + FormatTagSelector(b.TargetGroupTags)
+	case b.Listener != nil:
+		ref = listenerBindingPrefix + b.Listener.String()
+	default:
+		ref = b.TargetGroupName
+	}
+	if b.Port != nil {
+		return fmt.Sprintf("%s:%d", ref, aws.Int64Value(b.Port))
+	}
+	if b.PortName != "" {
+		return fmt.Sprintf("%s:%s", ref, b.PortName)
+	}
+	return ref
+}
+
+// Bindings is a repeatable flag value holding all target groups
+// the target should be registered in.
+type Bindings []*Binding
+
+func (b *Bindings) Set(value string) error {
+	binding, err := ParseBinding(value)
+	if err != nil {
+		return err
+	}
+	*b = append(*b, binding)
+	return nil
+}
+
+func (b *Bindings) String() string {
+	if b == nil {
+		return ""
+	}
+	values := make([]string, 0, len(*b))
+	for _, binding := range *b {
+		values = append(values, binding.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (b *Bindings) Type() string {
+	return "binding"
+}
+
+func (b *Bindings) IsCumulative() bool {
+	return true
+}
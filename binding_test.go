@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testTargetGroupArn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067"
+
+type parseBindingTest struct {
+	value string
+	want  *Binding
+	err   bool
+}
+
+func testParseBinding(t *testing.T, tests []parseBindingTest) {
+	t.Helper()
+	for _, tt := range tests {
+		binding, err := ParseBinding(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseBinding(%q) = %+v, want error", tt.value, binding)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBinding(%q): %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(binding, tt.want) {
+			t.Errorf("ParseBinding(%q) = %+v, want %+v", tt.value, binding, tt.want)
+		}
+	}
+}
+
+func TestParseBinding(t *testing.T) {
+	testParseBinding(t, []parseBindingTest{
+		{value: "my-targets", want: &Binding{TargetGroupName: "my-targets"}},
+		{value: "my-targets:9092", want: &Binding{TargetGroupName: "my-targets", Port: aws.Int64(9092)}},
+		{value: "my-targets:kafka", want: &Binding{TargetGroupName: "my-targets", PortName: "kafka"}},
+		{value: testTargetGroupArn, want: &Binding{TargetGroupArn: testTargetGroupArn}},
+		{value: testTargetGroupArn + ":9092", want: &Binding{TargetGroupArn: testTargetGroupArn, Port: aws.Int64(9092)}},
+		{value: "", err: true},
+		{value: ":9092", err: true},
+		{value: "my-targets:0", err: true},
+		{value: "my-targets:65536", err: true},
+		{value: "my-targets:Kafka_Port", err: true},
+		{value: "arn:aws:elasticloadbalancing", err: true},
+	})
+}
+
+func TestBindingsSet(t *testing.T) {
+	var bindings Bindings
+	for _, value := range []string{"kafka-internal:9092", "kafka-external:9094"} {
+		if err := bindings.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	if len(bindings) != 2 || bindings[0].TargetGroupName != "kafka-internal" || bindings[1].TargetGroupName != "kafka-external" {
+		t.Errorf("bindings = %v, want both target groups in order", bindings)
+	}
+}
+
+func TestParseBindingTags(t *testing.T) {
+	testParseBinding(t, []parseBindingTest{
+		{
+			value: "tags:service=kafka,env=prod",
+			want:  &Binding{TargetGroupTags: map[string]string{"service": "kafka", "env": "prod"}},
+		},
+		{
+			value: "tags:service=kafka,env=prod:9092",
+			want:  &Binding{TargetGroupTags: map[string]string{"service": "kafka", "env": "prod"}, Port: aws.Int64(9092)},
+		},
+		{
+			// Only a numeric last part is a port, tag values may contain
+			// colons
+			value: "tags:owner=team:kafka",
+			want:  &Binding{TargetGroupTags: map[string]string{"owner": "team:kafka"}},
+		},
+		{
+			value: "tags:owner=team:kafka:9092",
+			want:  &Binding{TargetGroupTags: map[string]string{"owner": "team:kafka"}, Port: aws.Int64(9092)},
+		},
+		{
+			value: "tags:env={{.Namespace}}",
+			want:  &Binding{TargetGroupTags: map[string]string{"env": "{{.Namespace}}"}},
+		},
+		{value: "tags:", err: true},
+		{value: "tags:service", err: true},
+		{value: "tags:=kafka", err: true},
+		{value: "tags:service=kafka:0", err: true},
+	})
+}
+
+func TestParseBindingListener(t *testing.T) {
+	testParseBinding(t, []parseBindingTest{
+		{
+			value: "lb:kafka-nlb:9094",
+			want:  &Binding{Listener: &Listener{LoadBalancerName: "kafka-nlb", Port: 9094}},
+		},
+		{
+			value: "lb:kafka-nlb:9094:9092",
+			want:  &Binding{Listener: &Listener{LoadBalancerName: "kafka-nlb", Port: 9094}, Port: aws.Int64(9092)},
+		},
+		{
+			value: "lb:kafka-nlb:9094:kafka",
+			want:  &Binding{Listener: &Listener{LoadBalancerName: "kafka-nlb", Port: 9094}, PortName: "kafka"},
+		},
+		{value: "lb:kafka-nlb", err: true},
+		{value: "lb::9094", err: true},
+		{value: "lb:kafka-nlb:https", err: true},
+		{value: "lb:kafka-nlb:0", err: true},
+	})
+}
@@ -1,6 +1,32 @@
 package constants
 
 const (
-	TargetID       = "target_id"
-	TargetGroupArn = "target_group_arn"
+	TargetID         = "target_id"
+	TargetGroupArn   = "target_group_arn"
+	TargetGroupName  = "target_group_name"
+	Port             = "port"
+	AvailabilityZone = "availability_zone"
+)
+
+const (
+	// Pod annotation prefix used to define named ports, Downward API
+	// doesn't expose container ports
+	NamedPortAnnotationPrefix = "k8s-nlb-registrator-sidecar/port-"
+
+	// Pod annotation repeating terminationGracePeriodSeconds, Downward API
+	// doesn't expose the pod spec
+	TerminationGracePeriodAnnotation = "k8s-nlb-registrator-sidecar/termination-grace-period-seconds"
+
+	// Environment variable with the count of connections left after
+	// draining, passed to the post-deregister command
+	RemainingConnectionsEnv = "REMAINING_CONNECTIONS"
+
+	// Environment variable with the target state set by the watchdog,
+	// passed to the watchdog command
+	WatchdogStateEnv = "WATCHDOG_STATE"
+
+	// Environment variables with the lifecycle states of a transition,
+	// passed to the lifecycle command
+	LifecycleStateEnv         = "LIFECYCLE_STATE"
+	LifecyclePreviousStateEnv = "LIFECYCLE_PREVIOUS_STATE"
 )
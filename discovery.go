@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/eapache/go-resiliency/retrier"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// TargetBindings returns all target groups the target should be registered in.
+// TargetGroupName and the other single target group flags are kept for
+// backwards compatibility and are treated as one more binding.
+func (a *App) TargetBindings() (Bindings, error) {
+	bindings := Bindings{}
+	if a.TargetGroupName != "" {
+		bindings = append(bindings, &Binding{TargetGroupName: a.TargetGroupName})
+	}
+	if a.TargetGroupArn != "" {
+		bindings = append(bindings, &Binding{TargetGroupArn: a.TargetGroupArn})
+	}
+	if len(a.TargetGroupTags) > 0 {
+		tags, err := ParseTagSelector(a.TargetGroupTags)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, &Binding{TargetGroupTags: tags})
+	}
+	if a.LoadBalancerListener != "" {
+		listener, err := ParseListener(a.LoadBalancerListener)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, &Binding{Listener: listener})
+	}
+	bindings = append(bindings, a.Bindings...)
+
+	if len(bindings) == 0 {
+		return nil, errors.New("no target group given, please set target-group-name, target-group-arn, target-group-tags, load-balancer-listener or binding")
+	}
+	return bindings, nil
+}
+
+func renderBindings(app *App, bindings Bindings) error {
+	metadata, err := app.Pod.Metadata()
+	if err != nil {
+		return err
+	}
+
+	for _, binding := range bindings {
+		if err := binding.Render(metadata); err != nil {
+			return fmt.Errorf("rendering binding %s: %v", binding, err)
+		}
+	}
+	return nil
+}
+
+func resolvePorts(app *App, bindings Bindings) error {
+	namedPorts, err := app.Pod.NamedPorts()
+	if err != nil {
+		return err
+	}
+
+	for _, binding := range bindings {
+		if err := binding.ResolvePort(app.TargetPort, namedPorts); err != nil {
+			return fmt.Errorf("resolving port of binding %s: %v", binding, err)
+		}
+	}
+	return nil
+}
+
+// discoverTargetGroups finds the target group of every binding. Bindings
+// given by ARN skip discovery, their target group is only described to
+// validate it.
+func discoverTargetGroups(bindings Bindings, registratorService *RegistratorService, region, targetType string, ipAddressTypes *TargetGroupIPAddressTypes, logger log.Logger) error {
+	for _, binding := range bindings {
+		// Target groups which can't be described are expected to be ipv4
+		binding.IPAddressType = ipAddressTypeIPv4
+
+		if binding.TargetGroupArn != "" {
+			if err := ValidateTargetGroupArn(binding.TargetGroupArn, region); err != nil {
+				return err
+			}
+
+			targetGroup, err := describeTargetGroup(binding.TargetGroupArn, registratorService)
+			if err != nil {
+				if !isAccessError(err) {
+					return fmt.Errorf("describing target group %s: %v", binding.TargetGroupArn, err)
+				}
+				// Missing elbv2:DescribeTargetGroups permission, a target
+				// group which doesn't exist fails above
+				level.Warn(logger).Log("msg", "Unable to describe target group, skipping validation", constants.TargetGroupArn, binding.TargetGroupArn, "error", err)
+				continue
+			}
+			binding.TargetGroup = targetGroup
+		} else {
+			ref := binding.String()
+			targetGroup, err := discoverTargetGroup(binding, registratorService)
+			if err != nil {
+				return fmt.Errorf("discovering target group %s: %v", ref, err)
+			}
+			binding.TargetGroup = targetGroup
+			binding.TargetGroupArn = aws.StringValue(targetGroup.TargetGroupArn)
+			binding.TargetGroupName = aws.StringValue(targetGroup.TargetGroupName)
+			binding.Discovered = true
+			log.With(logger, binding.LogContext()...).Log("msg", "Discovered target group", "binding", ref)
+		}
+
+		if err := validateTargetGroup(binding.TargetGroup, targetType); err != nil {
+			return err
+		}
+		binding.IPAddressType = ipAddressTypes.Get(binding.TargetGroupArn)
+	}
+	return nil
+}
+
+func discoverTargetGroup(binding *Binding, registratorService *RegistratorService) (*elbv2.TargetGroup, error) {
+	var targetGroup *elbv2.TargetGroup
+	discoverTargetGroupRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), nil)
+	err := discoverTargetGroupRetrier.Run(func() error {
+		var err error
+		switch {
+		case binding.TargetGroupTags != nil:
+			targetGroup, err = registratorService.DiscoverTargetGroupByTags(binding.TargetGroupTags)
+		case binding.Listener != nil:
+			targetGroup, err = registratorService.DiscoverTargetGroupByListener(binding.Listener.LoadBalancerName, binding.Listener.Port)
+		default:
+			targetGroup, err = registratorService.DiscoverTargetGroup(binding.TargetGroupName)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return targetGroup, nil
+}
+
+func describeTargetGroup(targetGroupArn string, registratorService *RegistratorService) (*elbv2.TargetGroup, error) {
+	var targetGroup *elbv2.TargetGroup
+	describeRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), accessErrorClassifier{})
+	err := describeRetrier.Run(func() error {
+		var err error
+		targetGroup, err = registratorService.DescribeTargetGroup(targetGroupArn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return targetGroup, nil
+}
+
+func validateTargetGroup(targetGroup *elbv2.TargetGroup, expectedTargetType string) error {
+	if targetType := aws.StringValue(targetGroup.TargetType); targetType != expectedTargetType {
+		return fmt.Errorf("target group %s has target type %q, expected %q", aws.StringValue(targetGroup.TargetGroupArn), targetType, expectedTargetType)
+	}
+	return nil
+}
+
+// ValidateTargetGroupArn checks that ARN references a target group in the
+// region of the session, e.g.
+// arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067
+func ValidateTargetGroupArn(targetGroupArn, region string) error {
+	parts := strings.SplitN(targetGroupArn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "elasticloadbalancing" {
+		return fmt.Errorf("%q is not an elastic load balancing ARN", targetGroupArn)
+	}
+
+	resource := strings.Split(parts[5], "/")
+	if len(resource) != 3 || resource[0] != "targetgroup" || resource[1] == "" || resource[2] == "" {
+		return fmt.Errorf("%q is not a target group ARN", targetGroupArn)
+	}
+
+	if region != "" && parts[3] != region {
+		return fmt.Errorf("target group %q is in region %q, but the session uses region %q", targetGroupArn, parts[3], region)
+	}
+	return nil
+}
+
+// isAccessError reports whether the target group can't be seen by the
+// current credentials
+func isAccessError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "AccessDenied", "AccessDeniedException":
+		return true
+	}
+	return false
+}
+
+// isNotFoundError reports whether the target group doesn't exist, e.g. the
+// ARN is mistyped or from another account
+func isNotFoundError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == elbv2.ErrCodeTargetGroupNotFoundException
+}
+
+// accessErrorClassifier doesn't retry errors which won't go away
+type accessErrorClassifier struct{}
+
+func (accessErrorClassifier) Classify(err error) retrier.Action {
+	switch {
+	case err == nil:
+		return retrier.Succeed
+	case isAccessError(err), isNotFoundError(err):
+		return retrier.Fail
+	default:
+		return retrier.Retry
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestValidateTargetGroupArn(t *testing.T) {
+	tests := []struct {
+		arn    string
+		region string
+		err    bool
+	}{
+		{arn: testTargetGroupArn, region: "us-east-1"},
+		// Without a region in the session there is nothing to compare to
+		{arn: testTargetGroupArn, region: ""},
+		{arn: "arn:aws-cn:elasticloadbalancing:cn-north-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067", region: "cn-north-1"},
+		{arn: testTargetGroupArn, region: "eu-west-1", err: true},
+		{arn: "arn:aws:ec2:us-east-1:123456789012:instance/i-0123456789abcdef0", region: "us-east-1", err: true},
+		{arn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/net/my-nlb/50dc6c495c0c9188", region: "us-east-1", err: true},
+		{arn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/my-targets", region: "us-east-1", err: true},
+		{arn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup//73e2d6bc24d8a067", region: "us-east-1", err: true},
+		{arn: "arn:aws:elasticloadbalancing:us-east-1", region: "us-east-1", err: true},
+		{arn: "my-targets", region: "us-east-1", err: true},
+	}
+	for _, tt := range tests {
+		err := ValidateTargetGroupArn(tt.arn, tt.region)
+		if tt.err && err == nil {
+			t.Errorf("ValidateTargetGroupArn(%q, %q) = nil, want error", tt.arn, tt.region)
+		}
+		if !tt.err && err != nil {
+			t.Errorf("ValidateTargetGroupArn(%q, %q): %v", tt.arn, tt.region, err)
+		}
+	}
+}
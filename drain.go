@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"k8s-nlb-registrator-sidecar/constants"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type ConnectionDrain struct {
+	Port     int           `desc:"Local port whose established connections are counted after deregistration, 0 disables waiting for connections to drain"`
+	Floor    int           `desc:"Count of connections at which draining is considered done"`
+	Timeout  time.Duration `desc:"How long to wait for connections to drain"`
+	Interval time.Duration `desc:"How often to count connections"`
+}
+
+// WaitConnectionsDrained waits until the count of established connections
+// to the port drops to the floor or the timeout expires, it returns the
+// count of remaining connections
+func WaitConnectionsDrained(ctx context.Context, drain *ConnectionDrain, logger log.Logger) int {
+	logger = log.With(logger, constants.Port, drain.Port)
+
+	ctx, cancel := context.WithTimeout(ctx, drain.Timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(drain.Interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	count := -1
+	for {
+		sockets, err := ReadTCPSockets(procNetDir)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to count connections", "error", err)
+		} else {
+			count = CountEstablished(sockets, drain.Port)
+		}
+
+		if count >= 0 && count <= drain.Floor {
+			logger.Log("msg", "Connections are drained", "connections", count, "elapsed", time.Since(started).Round(time.Second))
+			return count
+		}
+		logger.Log("msg", "Waiting for connections to drain", "connections", count, "floor", drain.Floor, "elapsed", time.Since(started).Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			level.Warn(logger).Log("msg", "Gave up waiting for connections to drain", "connections", count)
+			return count
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"os"
 	"os/exec"
 
 	"github.com/go-kit/kit/log"
 )
 
-func ExecCommand(ctx context.Context, logger log.Logger, command string) error {
+// ExecCommand executes command with the environment of the process extended
+// with env in key=value form
+func ExecCommand(ctx context.Context, logger log.Logger, command string, env ...string) error {
 	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	combinedOutput, err := cmd.CombinedOutput()
 	logger.Log("output", string(combinedOutput))
 	return err
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Exit codes of the process
+const (
+	// ExitCodeOK is returned after the target was deregistered on signal
+	ExitCodeOK = 0
+	// ExitCodeStartupFailed is returned when flags are invalid or target
+	// groups and target ID can't be resolved
+	ExitCodeStartupFailed = 1
+	// ExitCodeRegistrationFailed is returned by the exit registration
+	// failure policy
+	ExitCodeRegistrationFailed = 3
+	// ExitCodeForceExit is returned on the force exit signal
+	ExitCodeForceExit = 4
+	// ExitCodeCleanupFailed is returned by the cleanup subcommand when
+	// targets couldn't be deregistered
+	ExitCodeCleanupFailed = 5
+	// ExitCodeDeregistrationFailed is returned after the signal when the
+	// target couldn't be deregistered from all target groups
+	ExitCodeDeregistrationFailed = 6
+)
+
+const (
+	registrationFailureIgnore    = "ignore"
+	registrationFailureRetry     = "retry"
+	registrationFailureExit      = "exit"
+	registrationFailureUnhealthy = "unhealthy"
+)
+
+type RegistrationFailure struct {
+	Policy     string        `desc:"What to do when registration or waiting for the target to be in service fails: ignore keeps running unregistered, retry retries forever with capped backoff, exit deregisters the target and exits with code 3 so the container is restarted, unhealthy deregisters the target and writes the error to -registration-failure-file"`
+	MaxBackoff time.Duration `desc:"Maximum wait between registration attempts of the retry policy"`
+	File       string        `desc:"File written by the unhealthy policy, use it in a readiness or liveness probe, e.g. test ! -f <file>. It is removed before registration"`
+}
+
+func (f *RegistrationFailure) Validate() error {
+	switch f.Policy {
+	case registrationFailureIgnore, registrationFailureRetry, registrationFailureExit:
+	case registrationFailureUnhealthy:
+		if f.File == "" {
+			return fmt.Errorf("registration failure policy %q requires a registration failure file", f.Policy)
+		}
+	default:
+		return fmt.Errorf("unsupported registration failure policy %q, expected %q, %q, %q or %q", f.Policy,
+			registrationFailureIgnore, registrationFailureRetry, registrationFailureExit, registrationFailureUnhealthy)
+	}
+	return nil
+}
+
+// registerWithPolicy runs register, which waits for the target to be ready
+// and registers it in all target groups, and applies the registration
+// failure policy when it fails. Failed registrations are rolled back by
+// register. It returns false when the target stays unregistered.
+func registerWithPolicy(ctx context.Context, app *App, register func() error, logger log.Logger) bool {
+	policy := app.RegistrationFailure
+	if policy.File != "" {
+		if err := os.Remove(policy.File); err != nil && !os.IsNotExist(err) {
+			level.Warn(logger).Log("msg", "Failed to remove registration failure file", "file", policy.File, "error", err)
+		}
+	}
+
+	backoff := 1 * time.Second
+	for {
+		err := register()
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			// Deregistration was requested meanwhile
+			return false
+		}
+
+		switch policy.Policy {
+		case registrationFailureRetry:
+			logger.Log("msg", "Retrying target registration", "backoff", backoff)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		case registrationFailureExit:
+			level.Error(logger).Log("msg", "Target registration failed, exiting", "exit_code", ExitCodeRegistrationFailed, "error", err)
+			os.Exit(ExitCodeRegistrationFailed)
+		case registrationFailureUnhealthy:
+			level.Error(logger).Log("msg", "Target registration failed, marking unhealthy", "file", policy.File, "error", err)
+			if err := ioutil.WriteFile(policy.File, []byte(err.Error()+"\n"), 0644); err != nil {
+				level.Error(logger).Log("msg", "Failed to write registration failure file", "file", policy.File, "error", err)
+			}
+			return false
+		default:
+			level.Error(logger).Log("msg", "Target registration failed, staying unregistered", "error", err)
+			return false
+		}
+	}
+}
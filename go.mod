@@ -5,29 +5,7 @@ go 1.12
 require (
 	github.com/aws/aws-sdk-go v1.28.9
 	github.com/eapache/go-resiliency v1.2.0
-	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/go-kit/kit v0.9.0
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
-	github.com/go-logr/logr v0.1.0 // indirect
-	github.com/go-logr/zapr v0.1.1 // indirect
-	github.com/go-stack/stack v1.8.0 // indirect
-	github.com/gogo/protobuf v1.2.1 // indirect
-	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/imdario/mergo v0.3.7 // indirect
 	github.com/octago/sflags v0.2.0
-	github.com/pkg/errors v0.8.1 // indirect
-	go.uber.org/atomic v1.4.0 // indirect
-	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.10.0 // indirect
-	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
-	golang.org/x/net v0.0.0-20190628185345-da137c7871d7 // indirect
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
-	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7 // indirect
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
-	google.golang.org/appengine v1.6.1 // indirect
-	k8s.io/apiextensions-apiserver v0.0.0-20190713023830-b4b8a3310a45 // indirect
-	k8s.io/client-go v11.0.0+incompatible // indirect
-	k8s.io/klog v0.3.3 // indirect
-	sigs.k8s.io/controller-runtime v0.1.12
-	sigs.k8s.io/testing_frameworks v0.1.1 // indirect
 )
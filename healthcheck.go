@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	healthCheckTrafficPort = "traffic-port"
+	// Network Load Balancers accept 200-399 when the matcher isn't set
+	defaultHealthCheckMatcher  = "200-399"
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 10 * time.Second
+)
+
+type LocalHealthCheck struct {
+	Enabled  bool          `desc:"Whether to run the target group health check against the pod locally until it passes before target is registered"`
+	Timeout  time.Duration `desc:"How long to wait for local health check to pass"`
+	Interval time.Duration `desc:"How often to run local health check, target group health check interval is used when 0"`
+}
+
+// HealthCheck is a copy of the target group health check which is run
+// against the pod directly
+type HealthCheck struct {
+	Protocol         string
+	Address          string
+	Path             string
+	Matcher          string
+	HealthyThreshold int
+	Interval         time.Duration
+	Timeout          time.Duration
+}
+
+// NewHealthCheck copies health check settings of the target group, host and
+// port are where the target receives traffic
+func NewHealthCheck(targetGroup *elbv2.TargetGroup, host string, port *int64) (*HealthCheck, error) {
+	if port == nil {
+		port = targetGroup.Port
+	}
+
+	healthCheckPort := aws.StringValue(targetGroup.HealthCheckPort)
+	if healthCheckPort == "" || healthCheckPort == healthCheckTrafficPort {
+		healthCheckPort = strconv.FormatInt(aws.Int64Value(port), 10)
+	}
+
+	matcher := defaultHealthCheckMatcher
+	if targetGroup.Matcher != nil && aws.StringValue(targetGroup.Matcher.HttpCode) != "" {
+		matcher = aws.StringValue(targetGroup.Matcher.HttpCode)
+	}
+
+	check := &HealthCheck{
+		Protocol:         aws.StringValue(targetGroup.HealthCheckProtocol),
+		Address:          net.JoinHostPort(host, healthCheckPort),
+		Path:             aws.StringValue(targetGroup.HealthCheckPath),
+		Matcher:          matcher,
+		HealthyThreshold: int(aws.Int64Value(targetGroup.HealthyThresholdCount)),
+		Interval:         time.Duration(aws.Int64Value(targetGroup.HealthCheckIntervalSeconds)) * time.Second,
+		Timeout:          time.Duration(aws.Int64Value(targetGroup.HealthCheckTimeoutSeconds)) * time.Second,
+	}
+
+	switch check.Protocol {
+	case elbv2.ProtocolEnumTcp, elbv2.ProtocolEnumHttp, elbv2.ProtocolEnumHttps:
+	default:
+		return nil, fmt.Errorf("health check protocol %q is not supported", check.Protocol)
+	}
+	if check.HealthyThreshold < 1 {
+		check.HealthyThreshold = 1
+	}
+	if check.Interval == 0 {
+		check.Interval = defaultHealthCheckInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthCheckTimeout
+	}
+	return check, nil
+}
+
+// Check runs the health check once
+func (h *HealthCheck) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	if h.Protocol == elbv2.ProtocolEnumTcp {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", h.Address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	url := fmt.Sprintf("%s://%s%s", strings.ToLower(h.Protocol), h.Address, h.Path)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			// Load balancers don't validate certificates of targets
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			// Load balancers open a new connection for every check, a
+			// kept alive connection would also leak with every client
+			DisableKeepAlives: true,
+		},
+		// Redirects are matched against the matcher as they are
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !MatchHTTPCode(h.Matcher, resp.StatusCode) {
+		return fmt.Errorf("%s returned %d, expected %s", url, resp.StatusCode, h.Matcher)
+	}
+	return nil
+}
+
+// MatchHTTPCode matches status code against matcher like 200, 200,202 or
+// 200-299
+func MatchHTTPCode(matcher string, code int) bool {
+	for _, part := range strings.Split(matcher, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		if code >= low && code <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitHealthy runs the health check until it passes healthy threshold times
+// in a row
+func WaitHealthy(ctx context.Context, check *HealthCheck, timeout, interval time.Duration, logger log.Logger) error {
+	if interval == 0 {
+		interval = check.Interval
+	}
+	logger = log.With(logger, "protocol", check.Protocol, "address", check.Address)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	passed := 0
+	var lastErr error
+	for {
+		if lastErr = check.Check(ctx); lastErr != nil {
+			passed = 0
+			logger.Log("msg", "Local health check failed", "error", lastErr)
+		} else {
+			passed++
+			logger.Log("msg", "Local health check passed", "passed", passed, "healthy_threshold", check.HealthyThreshold)
+			if passed >= check.HealthyThreshold {
+				logger.Log("msg", "Target is healthy locally", "elapsed", time.Since(started).Round(time.Second))
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("local health check didn't pass %d times in a row within %s, last error: %v", check.HealthyThreshold, timeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
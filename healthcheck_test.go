@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestMatchHTTPCode(t *testing.T) {
+	tests := []struct {
+		matcher string
+		code    int
+		match   bool
+	}{
+		{matcher: "200", code: 200, match: true},
+		{matcher: "200", code: 204, match: false},
+		{matcher: "200,202", code: 202, match: true},
+		{matcher: "200, 202", code: 202, match: true},
+		{matcher: "200,202", code: 201, match: false},
+		{matcher: defaultHealthCheckMatcher, code: 200, match: true},
+		{matcher: defaultHealthCheckMatcher, code: 399, match: true},
+		{matcher: defaultHealthCheckMatcher, code: 301, match: true},
+		{matcher: defaultHealthCheckMatcher, code: 404, match: false},
+		{matcher: "200,300-302", code: 302, match: true},
+		// Malformed parts are skipped, the rest still match
+		{matcher: "ok,204", code: 204, match: true},
+		{matcher: "200-x", code: 200, match: false},
+		{matcher: "", code: 200, match: false},
+	}
+	for _, tt := range tests {
+		if match := MatchHTTPCode(tt.matcher, tt.code); match != tt.match {
+			t.Errorf("MatchHTTPCode(%q, %d) = %t, want %t", tt.matcher, tt.code, match, tt.match)
+		}
+	}
+}
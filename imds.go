@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imdsTokenTTL     = 6 * time.Hour
+	imdsTokenPath    = "/latest/api/token"
+	imdsMetadataPath = "/latest/meta-data/"
+)
+
+// MetadataClient reads EC2 instance metadata. IMDSv2 session tokens are used
+// when available, otherwise it falls back to IMDSv1.
+type MetadataClient struct {
+	Endpoint   string
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewMetadataClient(endpoint string) *MetadataClient {
+	return &MetadataClient{
+		Endpoint:   strings.TrimRight(endpoint, "/"),
+		HTTPClient: &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+// ErrMetadataNotFound is returned when the metadata path doesn't exist, e.g.
+// spot/instance-action when there is no interruption notice
+type ErrMetadataNotFound struct {
+	Path string
+}
+
+func (e *ErrMetadataNotFound) Error() string {
+	return fmt.Sprintf("instance metadata %s not found", e.Path)
+}
+
+// Get returns the value of a metadata path, e.g. instance-id
+func (c *MetadataClient) Get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Endpoint+imdsMetadataPath+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := c.sessionToken(ctx); token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return strings.TrimSpace(string(body)), nil
+	case http.StatusNotFound:
+		return "", &ErrMetadataNotFound{Path: path}
+	default:
+		return "", fmt.Errorf("instance metadata %s returned %s", path, resp.Status)
+	}
+}
+
+// sessionToken returns cached IMDSv2 token, an empty token means IMDSv1
+func (c *MetadataClient) sessionToken(ctx context.Context) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.Endpoint+imdsTokenPath, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(imdsTokenTTL.Seconds())))
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+
+	c.token = string(token)
+	// Refresh the token well before it expires
+	c.tokenExpiry = time.Now().Add(imdsTokenTTL - time.Minute)
+	return c.token
+}
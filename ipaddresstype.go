@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	ipAddressTypeIPv4 = "ipv4"
+	ipAddressTypeIPv6 = "ipv6"
+)
+
+// TargetGroupIPAddressTypes records IpAddressType of target groups returned by
+// DescribeTargetGroups. The aws-sdk-go version this module depends on
+// doesn't model TargetGroup.IpAddressType yet, so it is read from the raw
+// response before the SDK unmarshals it.
+type TargetGroupIPAddressTypes struct {
+	mu    sync.Mutex
+	types map[string]string
+}
+
+type describeTargetGroupsResponse struct {
+	TargetGroups []struct {
+		TargetGroupArn string `xml:"TargetGroupArn"`
+		IPAddressType  string `xml:"IpAddressType"`
+	} `xml:"DescribeTargetGroupsResult>TargetGroups>member"`
+}
+
+func NewTargetGroupIPAddressTypes() *TargetGroupIPAddressTypes {
+	return &TargetGroupIPAddressTypes{types: map[string]string{}}
+}
+
+// Get returns IP address type of the target group, target groups created
+// before IPv6 support don't report it and are ipv4
+func (t *TargetGroupIPAddressTypes) Get(targetGroupArn string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ipAddressType, ok := t.types[targetGroupArn]; ok && ipAddressType != "" {
+		return ipAddressType
+	}
+	return ipAddressTypeIPv4
+}
+
+// UnmarshalHandler has to run in front of the SDK unmarshal handlers
+func (t *TargetGroupIPAddressTypes) UnmarshalHandler(r *request.Request) {
+	if r.Operation.Name != "DescribeTargetGroups" || r.HTTPResponse == nil || r.HTTPResponse.Body == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	r.HTTPResponse.Body.Close()
+	// Let the SDK unmarshal the response as if it wasn't read
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	var resp describeTargetGroupsResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, targetGroup := range resp.TargetGroups {
+		t.types[targetGroup.TargetGroupArn] = targetGroup.IPAddressType
+	}
+}
+
+// ipAddressType returns ipv4 or ipv6 depending on the address family of ip
+func ipAddressType(ip net.IP) string {
+	if ip.To4() != nil {
+		return ipAddressTypeIPv4
+	}
+	return ipAddressTypeIPv6
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	journalFile = "registrations"
+	// cleanupCommand deregisters all targets in the journal, e.g. from a
+	// preStop hook
+	cleanupCommand = "cleanup"
+)
+
+// RegistrationJournal records targets registered by the sidecar in a
+// directory which survives container restarts, e.g. an emptyDir volume.
+// Targets are added before they are registered and removed after they are
+// deregistered, so targets left behind by an OOM kill or SIGKILL can be
+// deregistered later. The file is locked while it is updated.
+type RegistrationJournal struct {
+	Dir string
+}
+
+// JournalEntry is a registered target
+type JournalEntry struct {
+	TargetGroupArn   string `json:"target_group_arn"`
+	TargetID         string `json:"target_id"`
+	Port             *int64 `json:"port,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+}
+
+func journalEntry(binding *Binding) JournalEntry {
+	return JournalEntry{
+		TargetGroupArn:   binding.TargetGroupArn,
+		TargetID:         binding.TargetID,
+		Port:             binding.Port,
+		AvailabilityZone: binding.AvailabilityZone,
+	}
+}
+
+func (e JournalEntry) key() string {
+	return fmt.Sprintf("%s|%s|%d", e.TargetGroupArn, e.TargetID, aws.Int64Value(e.Port))
+}
+
+// Binding returns binding of the recorded target
+func (e JournalEntry) Binding() *Binding {
+	return &Binding{
+		TargetGroupArn:   e.TargetGroupArn,
+		TargetID:         e.TargetID,
+		Port:             e.Port,
+		AvailabilityZone: e.AvailabilityZone,
+	}
+}
+
+// Add records the target of the binding
+func (j *RegistrationJournal) Add(binding *Binding) error {
+	entry := journalEntry(binding)
+	_, err := j.update(func(entries map[string]JournalEntry) {
+		entries[entry.key()] = entry
+	})
+	return err
+}
+
+// Remove removes the target of the binding from the journal
+func (j *RegistrationJournal) Remove(binding *Binding) error {
+	entry := journalEntry(binding)
+	_, err := j.update(func(entries map[string]JournalEntry) {
+		delete(entries, entry.key())
+	})
+	return err
+}
+
+// Contains reports whether the target of the binding is recorded
+func (j *RegistrationJournal) Contains(binding *Binding) (bool, error) {
+	entries, err := j.Entries()
+	if err != nil {
+		return false, err
+	}
+	key := journalEntry(binding).key()
+	for _, entry := range entries {
+		if entry.key() == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Entries returns all recorded targets
+func (j *RegistrationJournal) Entries() ([]JournalEntry, error) {
+	return j.update(func(map[string]JournalEntry) {})
+}
+
+func (j *RegistrationJournal) update(fn func(map[string]JournalEntry)) ([]JournalEntry, error) {
+	if err := os.MkdirAll(j.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.Dir, journalFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	entries := map[string]JournalEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line written by a killed process may be cut off
+			continue
+		}
+		entries[entry.key()] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	fn(entries)
+
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	list := make([]JournalEntry, 0, len(entries))
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, f.Sync()
+}
+
+// deregisterStaleTargets deregisters targets in the journal which don't
+// match any of the bindings, e.g. when the previous container was killed
+// and the target ID changed
+func deregisterStaleTargets(ctx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, logger log.Logger) error {
+	journal := app.Journal()
+	if journal == nil {
+		return nil
+	}
+
+	entries, err := journal.Entries()
+	if err != nil {
+		return fmt.Errorf("reading registration journal: %v", err)
+	}
+
+	current := map[string]bool{}
+	for _, binding := range bindings {
+		current[journalEntry(binding).key()] = true
+	}
+
+	stale := Bindings{}
+	for _, entry := range entries {
+		if !current[entry.key()] {
+			stale = append(stale, entry.Binding())
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	logger.Log("msg", "Deregistering stale targets from registration journal", "targets", len(stale))
+	// Stale targets don't get traffic for this container, startup doesn't
+	// wait for them to drain. Failed ones stay in the journal for the next
+	// start.
+	runBindings(stale, func(binding *Binding) error {
+		return deregisterTarget(ctx, app, binding, registratorService.With(binding.LogContext()...), false)
+	})
+	return nil
+}
+
+// runCleanup deregisters all targets in the journal and returns the exit
+// code, targets which couldn't be deregistered stay in the journal
+func runCleanup(logger log.Logger) int {
+	journal := app.Journal()
+	if journal == nil {
+		level.Error(logger).Log("error", "cleanup requires journal-dir")
+		return ExitCodeStartupFailed
+	}
+
+	entries, err := journal.Entries()
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to read registration journal", "error", err)
+		return ExitCodeStartupFailed
+	}
+	if len(entries) == 0 {
+		logger.Log("msg", "Registration journal is empty, nothing to clean up")
+		return ExitCodeOK
+	}
+
+	bindings := Bindings{}
+	for _, entry := range entries {
+		bindings = append(bindings, entry.Binding())
+	}
+
+	registratorService := New(elbv2.New(setupSession(logger)), logger)
+	logger.Log("msg", "Deregistering targets from registration journal", "targets", len(bindings))
+	if err := deregisterBindings(context.Background(), app, bindings, registratorService); err != nil {
+		level.Error(logger).Log("msg", "Failed to deregister targets from registration journal", "exit_code", ExitCodeCleanupFailed, "error", err)
+		return ExitCodeCleanupFailed
+	}
+	return ExitCodeOK
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesClient is a minimal in-cluster Kubernetes API client, it only
+// reads and watches nodes. client-go isn't a dependency of the sidecar.
+type KubernetesClient struct {
+	Host       string
+	TokenFile  string
+	HTTPClient *http.Client
+}
+
+// Node holds the fields of the Kubernetes Node object used by the sidecar
+type Node struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		Unschedulable bool `json:"unschedulable"`
+		Taints        []struct {
+			Key    string `json:"key"`
+			Value  string `json:"value"`
+			Effect string `json:"effect"`
+		} `json:"taints"`
+	} `json:"spec"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// NewInClusterKubernetesClient uses the pod service account and the API
+// server address from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT
+func NewInClusterKubernetesClient() (*KubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set, not running in a cluster")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+
+	return &KubernetesClient{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		TokenFile: filepath.Join(serviceAccountDir, "token"),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+func (c *KubernetesClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Host+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Projected service account tokens are rotated, the file is read for
+	// every request
+	token, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// GetNode returns the node with the given name
+func (c *KubernetesClient) GetNode(ctx context.Context, name string) (*Node, error) {
+	resp, err := c.get(ctx, "/api/v1/nodes/"+url.PathEscape(name), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	node := &Node{}
+	if err := json.NewDecoder(resp.Body).Decode(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// WatchNode calls fn with every change of the node after resourceVersion
+// until fn returns false or the API server closes the watch
+func (c *KubernetesClient) WatchNode(ctx context.Context, name, resourceVersion string, fn func(*Node) bool) error {
+	resp, err := c.get(ctx, "/api/v1/nodes", url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + name},
+		"resourceVersion": {resourceVersion},
+		"timeoutSeconds":  {"300"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := watchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+		case "ERROR":
+			return fmt.Errorf("watch of node %s failed: %s", name, string(event.Object))
+		default:
+			continue
+		}
+
+		node := &Node{}
+		if err := json.Unmarshal(event.Object, node); err != nil {
+			return err
+		}
+		if !fn(node) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKubernetesClient(t *testing.T, handler http.HandlerFunc) (*KubernetesClient, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	client := &KubernetesClient{Host: server.URL, TokenFile: tokenFile, HTTPClient: server.Client()}
+	return client, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKubernetesClientWatchNode(t *testing.T) {
+	const events = `{"type": "ADDED", "object": {"metadata": {"name": "node-1", "resourceVersion": "2"}, "spec": {}}}
+{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "3"}}}
+{"type": "MODIFIED", "object": {"metadata": {"name": "node-1", "resourceVersion": "4"}, "spec": {"unschedulable": true}}}
+`
+
+	tests := []struct {
+		name     string
+		events   string
+		versions []string
+		err      string
+	}{
+		{
+			name:     "closed",
+			events:   events,
+			versions: []string{"2", "4"},
+			err:      io.EOF.Error(),
+		},
+		{
+			name:     "error event",
+			events:   events + `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "reason": "Expired"}}` + "\n",
+			versions: []string{"2", "4"},
+			err:      "watch of node node-1 failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, done := testKubernetesClient(t, func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				if r.URL.Path != "/api/v1/nodes" || query.Get("watch") != "true" ||
+					query.Get("fieldSelector") != "metadata.name=node-1" || query.Get("resourceVersion") != "1" {
+					http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+					return
+				}
+				io.WriteString(w, tt.events)
+			})
+			defer done()
+
+			var versions []string
+			err := client.WatchNode(context.Background(), "node-1", "1", func(node *Node) bool {
+				versions = append(versions, node.Metadata.ResourceVersion)
+				return true
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("WatchNode error = %v, want %q", err, tt.err)
+			}
+			if strings.Join(versions, ",") != strings.Join(tt.versions, ",") {
+				t.Errorf("WatchNode saw versions %v, want %v", versions, tt.versions)
+			}
+		})
+	}
+}
+
+func TestKubernetesClientWatchNodeStop(t *testing.T) {
+	client, done := testKubernetesClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"type": "MODIFIED", "object": {"metadata": {"name": "node-1", "resourceVersion": "2"}, "spec": {"unschedulable": true}}}
+{"type": "MODIFIED", "object": {"metadata": {"name": "node-1", "resourceVersion": "3"}, "spec": {}}}
+`)
+	})
+	defer done()
+
+	calls := 0
+	err := client.WatchNode(context.Background(), "node-1", "1", func(node *Node) bool {
+		calls++
+		return !node.Spec.Unschedulable
+	})
+	if err != nil {
+		t.Errorf("WatchNode: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want the watch to stop when fn returns false", calls)
+	}
+}
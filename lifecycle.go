@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// State is the lifecycle state of the target across all target groups
+type State string
+
+const (
+	StatePending        State = "Pending"
+	StateRegistering    State = "Registering"
+	StateWaitingHealthy State = "WaitingHealthy"
+	StateInService      State = "InService"
+	StateDraining       State = "Draining"
+	StateDeregistered   State = "Deregistered"
+	StateFailed         State = "Failed"
+)
+
+// lifecycleTransitions lists allowed transitions. Deregistered targets are
+// registered again by the watchdog, failed ones by the retry registration
+// failure policy or the watchdog. Draining fails when deregistration fails.
+var lifecycleTransitions = map[State][]State{
+	StatePending:        {StateRegistering, StateDraining},
+	StateRegistering:    {StateWaitingHealthy, StateInService, StateFailed, StateDraining},
+	StateWaitingHealthy: {StateInService, StateFailed, StateDraining},
+	StateInService:      {StateDraining},
+	StateDraining:       {StateDeregistered, StateFailed},
+	StateDeregistered:   {StateRegistering, StateDraining},
+	StateFailed:         {StateRegistering, StateDraining},
+}
+
+// Transition is passed to lifecycle subscribers, Err is set for transitions
+// to Failed
+type Transition struct {
+	From State
+	To   State
+	Err  error
+	At   time.Time
+}
+
+// Subscriber is called with every transition in the order of transitions.
+// Subscribers run synchronously and must not change the lifecycle.
+type Subscriber func(Transition)
+
+// Lifecycle orders registration and deregistration of the target. Once
+// shutdown begins, the target can't be registered again, so a registration
+// can't land after the deregistration.
+type Lifecycle struct {
+	// inService is held for reading by WhileInService and for writing by
+	// transitions, so they wait for running repairs without blocking the
+	// state
+	inService   sync.RWMutex
+	mu          sync.Mutex
+	state       State
+	shutdown    bool
+	subscribers []Subscriber
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{state: StatePending}
+}
+
+// Subscribe adds subscriber for all following transitions
+func (l *Lifecycle) Subscribe(subscriber Subscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, subscriber)
+}
+
+// State returns the current state
+func (l *Lifecycle) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// Do runs fn with the current state, transitions wait until fn returns, so
+// fn must not call AWS. Bindings of the target may only change in fn within
+// WhileInService, everything reading them concurrently with the lifecycle
+// has to read them in fn as well.
+func (l *Lifecycle) Do(fn func(State)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn(l.state)
+}
+
+// WhileInService runs fn when the target is in service and returns whether
+// it did. Transitions wait until fn returns, so fn can't register the
+// target after it left service, but the state can be read and shutdown
+// begins meanwhile.
+func (l *Lifecycle) WhileInService(fn func()) bool {
+	l.inService.RLock()
+	defer l.inService.RUnlock()
+
+	l.mu.Lock()
+	inService := l.state == StateInService && !l.shutdown
+	l.mu.Unlock()
+	if !inService {
+		return false
+	}
+	fn()
+	return true
+}
+
+// Shutdown rejects all following transitions which would register the
+// target
+func (l *Lifecycle) Shutdown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shutdown = true
+}
+
+// Transition changes the state and notifies subscribers, it fails when the
+// transition isn't allowed
+func (l *Lifecycle) Transition(to State, err error) error {
+	l.inService.Lock()
+	defer l.inService.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.shutdown && (to == StateRegistering || to == StateWaitingHealthy || to == StateInService) {
+		return fmt.Errorf("target is shutting down, not transitioning to %s", to)
+	}
+	if !l.allowed(to) {
+		return fmt.Errorf("invalid lifecycle transition from %s to %s", l.state, to)
+	}
+
+	transition := Transition{From: l.state, To: to, Err: err, At: time.Now()}
+	l.state = to
+	// Subscribers are notified under the lock, so they see transitions in
+	// order
+	for _, subscriber := range l.subscribers {
+		subscriber(transition)
+	}
+	return nil
+}
+
+func (l *Lifecycle) allowed(to State) bool {
+	for _, state := range lifecycleTransitions[l.state] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// LogTransitions returns subscriber which logs every transition
+func LogTransitions(logger log.Logger) Subscriber {
+	return func(t Transition) {
+		keyvals := []interface{}{"msg", "Lifecycle transition", "from", t.From, "to", t.To}
+		if t.Err != nil {
+			level.Error(logger).Log(append(keyvals, "error", t.Err)...)
+			return
+		}
+		logger.Log(keyvals...)
+	}
+}
+
+type LifecycleHook struct {
+	Command string        `desc:"Command to execute on every lifecycle transition with LIFECYCLE_STATE and LIFECYCLE_PREVIOUS_STATE environment variables"`
+	Timeout time.Duration `desc:"How long to wait for lifecycle command to execute"`
+}
+
+// Subscriber returns subscriber executing the lifecycle command, it delays
+// the transition by at most the command timeout
+func (h *LifecycleHook) Subscriber(logger log.Logger) Subscriber {
+	return func(t Transition) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+		defer cancel()
+
+		logger.Log("msg", "Executing lifecycle command", "command", h.Command, "state", t.To)
+		ExecCommand(ctx, logger, h.Command,
+			constants.LifecycleStateEnv+"="+string(t.To),
+			constants.LifecyclePreviousStateEnv+"="+string(t.From))
+	}
+}
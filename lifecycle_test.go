@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testLifecycle returns lifecycle brought to the last of states
+func testLifecycle(t *testing.T, states ...State) *Lifecycle {
+	t.Helper()
+	lifecycle := NewLifecycle()
+	for _, state := range states {
+		if err := lifecycle.Transition(state, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return lifecycle
+}
+
+func TestLifecycleTransition(t *testing.T) {
+	lifecycle := testLifecycle(t)
+	var transitions []Transition
+	lifecycle.Subscribe(func(transition Transition) { transitions = append(transitions, transition) })
+
+	if err := lifecycle.Transition(StateInService, nil); err == nil {
+		t.Error("transition from Pending to InService succeeded")
+	}
+	failure := errors.New("registration failed")
+	for _, to := range []State{StateRegistering, StateFailed, StateRegistering, StateInService} {
+		var err error
+		if to == StateFailed {
+			err = failure
+		}
+		if err := lifecycle.Transition(to, err); err != nil {
+			t.Fatalf("Transition(%s): %v", to, err)
+		}
+	}
+	if err := lifecycle.Transition(StateRegistering, nil); err == nil {
+		t.Error("transition from InService to Registering succeeded")
+	}
+
+	if state := lifecycle.State(); state != StateInService {
+		t.Errorf("state = %s, want %s", state, StateInService)
+	}
+	// Rejected transitions aren't passed to subscribers
+	if len(transitions) != 4 {
+		t.Fatalf("subscriber got %d transitions, want 4", len(transitions))
+	}
+	if got := transitions[1]; got.From != StateRegistering || got.To != StateFailed || got.Err != failure {
+		t.Errorf("transition = %+v, want from Registering to Failed with error", got)
+	}
+}
+
+func TestLifecycleTransitionAfterShutdown(t *testing.T) {
+	tests := [][]State{
+		{},
+		{StateRegistering},
+		{StateRegistering, StateWaitingHealthy},
+		{StateRegistering, StateFailed},
+		{StateRegistering, StateInService, StateDraining, StateDeregistered},
+	}
+	for _, states := range tests {
+		lifecycle := testLifecycle(t, states...)
+		from := lifecycle.State()
+		lifecycle.Shutdown()
+
+		for _, to := range []State{StateRegistering, StateWaitingHealthy, StateInService} {
+			if err := lifecycle.Transition(to, nil); err == nil {
+				t.Errorf("transition from %s to %s after shutdown succeeded", from, to)
+			}
+		}
+		if state := lifecycle.State(); state != from {
+			t.Errorf("state = %s after rejected transitions, want %s", state, from)
+		}
+
+		// The target can still be deregistered
+		if err := lifecycle.Transition(StateDraining, nil); err != nil {
+			t.Errorf("transition from %s to Draining after shutdown: %v", from, err)
+			continue
+		}
+		if err := lifecycle.Transition(StateDeregistered, nil); err != nil {
+			t.Errorf("transition from Draining to Deregistered after shutdown: %v", err)
+		}
+	}
+}
+
+func TestLifecycleWhileInService(t *testing.T) {
+	lifecycle := testLifecycle(t, StateRegistering)
+	if lifecycle.WhileInService(func() { t.Error("fn ran while Registering") }) {
+		t.Error("WhileInService = true while Registering")
+	}
+
+	if err := lifecycle.Transition(StateInService, nil); err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- lifecycle.WhileInService(func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	// The transition waits for fn, reading the state doesn't
+	transitioned := make(chan error)
+	go func() { transitioned <- lifecycle.Transition(StateDraining, nil) }()
+	if state := lifecycle.State(); state != StateInService {
+		t.Errorf("state = %s while fn runs, want %s", state, StateInService)
+	}
+	select {
+	case <-transitioned:
+		t.Fatal("transition didn't wait for fn")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if ran := <-done; !ran {
+		t.Error("WhileInService = false while InService")
+	}
+	if err := <-transitioned; err != nil {
+		t.Fatalf("Transition(Draining): %v", err)
+	}
+
+	lifecycle = testLifecycle(t, StateRegistering, StateInService)
+	lifecycle.Shutdown()
+	if lifecycle.WhileInService(func() { t.Error("fn ran after shutdown") }) {
+		t.Error("WhileInService = true after shutdown")
+	}
+}
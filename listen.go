@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type WaitListen struct {
+	Port     int           `desc:"Local port which has to be in LISTEN state before target is registered, 0 disables the check"`
+	Timeout  time.Duration `desc:"How long to wait for the port to be in LISTEN state"`
+	Interval time.Duration `desc:"How often to check whether the port is in LISTEN state"`
+}
+
+// WaitListening waits until the application in the pod listens on the port,
+// so the load balancer doesn't health check the target before it can accept
+// connections
+func WaitListening(ctx context.Context, wait *WaitListen, logger log.Logger) error {
+	logger = log.With(logger, constants.Port, wait.Port)
+
+	ctx, cancel := context.WithTimeout(ctx, wait.Timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(wait.Interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	for {
+		sockets, err := ReadTCPSockets(procNetDir)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to read sockets", "error", err)
+		} else if IsListening(sockets, wait.Port) {
+			logger.Log("msg", "Port is listening", "elapsed", time.Since(started).Round(time.Second))
+			return nil
+		} else {
+			logger.Log("msg", "Waiting for port to be listening", "elapsed", time.Since(started).Round(time.Second))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("port %d is not listening after %s: %v", wait.Port, time.Since(started).Round(time.Second), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
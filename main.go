@@ -2,24 +2,35 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"k8s-nlb-registrator-sidecar/constants"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/eapache/go-resiliency/retrier"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/octago/sflags/gen/gflag"
-	"sigs.k8s.io/controller-runtime/pkg/runtime/signals"
 )
 
 var (
 	app = &App{
-		WaitInService:        true,
-		WaitInServiceTimeout: 5 * time.Minute,
+		WaitInService:            true,
+		WaitInServiceTimeout:     5 * time.Minute,
+		WaitInServiceInterval:    5 * time.Second,
+		WaitInServiceMaxInterval: 30 * time.Second,
+		WaitInServiceStates:      []string{elbv2.TargetHealthStateEnumHealthy},
+		WaitDrainedInterval:      5 * time.Second,
+		TargetType:               elbv2.TargetTypeEnumIp,
+		InstanceLockTTL:          5 * time.Minute,
+		VerifyTargetID:           true,
+		MetadataEndpoint:         "http://169.254.169.254",
+		ForceExitSignal:          "SIGQUIT",
 		PreRegister: &PreRegisterHook{
 			Command: "",
 			Timeout: 5 * time.Second,
@@ -32,6 +43,58 @@ var (
 			Command: "",
 			Timeout: 5 * time.Second,
 		},
+		WaitListen: &WaitListen{
+			Timeout:  5 * time.Minute,
+			Interval: 1 * time.Second,
+		},
+		LocalHealthCheck: &LocalHealthCheck{
+			Timeout: 5 * time.Minute,
+		},
+		Watchdog: &Watchdog{
+			Interval:         10 * time.Second,
+			Timeout:          5 * time.Second,
+			FailureThreshold: 3,
+			SuccessThreshold: 3,
+		},
+		Attachment: &Attachment{
+			Check:    attachmentCheckWait,
+			Timeout:  5 * time.Minute,
+			Interval: 10 * time.Second,
+		},
+		SpotNotice: &SpotNotice{
+			Interval: 5 * time.Second,
+		},
+		NodeWatch: &NodeWatch{
+			Name:          os.Getenv("NODE_NAME"),
+			Unschedulable: true,
+			Taints: []string{
+				"ToBeDeletedByClusterAutoscaler",
+				"karpenter.sh/disrupted",
+				"karpenter.sh/disruption",
+			},
+		},
+		LifecycleHook: &LifecycleHook{
+			Timeout: 5 * time.Second,
+		},
+		Shutdown: &ShutdownBudget{
+			Reserve: 5 * time.Second,
+		},
+		RegistrationFailure: &RegistrationFailure{
+			Policy:     registrationFailureIgnore,
+			MaxBackoff: 5 * time.Minute,
+		},
+		Reconcile: &Reconcile{
+			Jitter: 0.2,
+		},
+		ConnectionDrain: &ConnectionDrain{
+			Timeout:  5 * time.Minute,
+			Interval: 5 * time.Second,
+		},
+		Pod: &PodInfo{
+			Name:      os.Getenv("POD_NAME"),
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			UID:       os.Getenv("POD_UID"),
+		},
 	}
 )
 
@@ -51,62 +114,228 @@ type PostRegisterHook struct {
 }
 
 type App struct {
-	WaitInService        bool          `desc:"Whether to wait for target group to become healthy"`
-	WaitInServiceTimeout time.Duration `desc:"How long to wait for target group to become healthy"`
-	TargetID             string        `desc:"Target ID to use"`
-	TargetGroupName      string        `desc:"Which target group to use for registering and deregistering targets"`
-	TargetGroupArn       string        `flag:"-"`
-	PreRegister          *PreRegisterHook
-	PostRegister         *PostRegisterHook
-	PostDeregister       *PostDeregisterHook
+	WaitInService            bool          `desc:"Whether to wait for target group to become healthy"`
+	WaitInServiceTimeout     time.Duration `desc:"How long to wait for target group to become healthy"`
+	WaitInServiceInterval    time.Duration `desc:"How often to poll target health while waiting for target to be in service, the interval doubles after every poll"`
+	WaitInServiceMaxInterval time.Duration `desc:"Maximum interval between target health polls while waiting for target to be in service"`
+	WaitInServiceStates      []string      `desc:"Target health states which count as in service, e.g. healthy and unused for target groups not attached to a load balancer yet, can be repeated"`
+	WaitDrained              bool          `desc:"Whether to wait for target to be drained, at most for the target group deregistration delay, before executing post-deregister command"`
+	WaitDrainedInterval      time.Duration `desc:"How often to check whether target is drained"`
+	TargetID                 string        `desc:"Target ID to use, comma separated IPv4 and IPv6 address for dual-stack pods, detected from POD_IPS/POD_IP environment variables, local interfaces or instance metadata when empty"`
+	TargetType               string        `desc:"Target type of target groups, ip or instance for hostNetwork and NodePort workloads"`
+	InstanceLockDir          string        `desc:"Node-local directory, e.g. hostPath volume, used to reference count pods sharing an instance target, the instance is deregistered only by the last of them"`
+	JournalDir               string        `desc:"Directory, e.g. emptyDir volume, to record registered targets in, targets left behind by a killed sidecar are deregistered on the next start or by the cleanup subcommand"`
+	InstanceLockTTL          time.Duration `desc:"How long a pod holds an instance target without refreshing it, holders of killed pods expire after it"`
+	VerifyTargetID           bool          `desc:"Whether to check that target IP is assigned to a local interface"`
+	MetadataEndpoint         string        `desc:"EC2 instance metadata endpoint"`
+	TargetGroupName          string        `desc:"Which target group to use for registering and deregistering targets"`
+	TargetGroupArn           string        `desc:"Target group ARN to register target in, skips target group discovery"`
+	TargetGroupTags          []string      `desc:"Tag selector key=value to discover target group by instead of name, values may use pod metadata templates, can be repeated"`
+	LoadBalancerListener     string        `desc:"Load balancer name and listener port <name>:<port> to discover target group from the listener default action"`
+	Bindings                 Bindings      `flag:"binding" desc:"Target group with an optional port <name|arn|tags:key=value,...|lb:load-balancer-name:listener-port>[:port], port is a number or a named container port (a number for tags), can be repeated"`
+	AvailabilityZone         string        `desc:"Availability zone to register targets with, 'all' for targets outside of the target group VPC or 'auto' to set 'all' when target IP is outside of the target group VPC CIDRs"`
+	TargetPort               string        `desc:"Port or named container port to register target with when binding has no port, target group port is used by default"`
+	WaitListen               *WaitListen
+	LocalHealthCheck         *LocalHealthCheck
+	Watchdog                 *Watchdog
+	Attachment               *Attachment
+	SpotNotice               *SpotNotice
+	NodeWatch                *NodeWatch
+	Shutdown                 *ShutdownBudget
+	RegistrationFailure      *RegistrationFailure
+	Reconcile                *Reconcile
+	ConnectionDrain          *ConnectionDrain
+	Pod                      *PodInfo
+	ForceExitSignal          string `desc:"Signal which exits immediately even while the target is being deregistered, repeated SIGTERM and SIGINT are ignored, empty disables it"`
+	PreRegister              *PreRegisterHook
+	PostRegister             *PostRegisterHook
+	PostDeregister           *PostDeregisterHook
+	LifecycleHook            *LifecycleHook
 }
 
 func main() {
 
 	logger := setupLogger()
 
-	if err := parseFlags(); err != nil {
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && args[0] == cleanupCommand {
+		command, args = args[0], args[1:]
+	}
+
+	if err := parseFlags(args); err != nil {
 		level.Error(logger).Log("error", err)
-		os.Exit(1)
+		os.Exit(ExitCodeStartupFailed)
 	}
 
-	logger = log.With(logger, constants.TargetID, app.TargetID)
+	if command == cleanupCommand {
+		os.Exit(runCleanup(logger))
+	}
+
+	if app.TargetType == elbv2.TargetTypeEnumInstance && app.InstanceLockDir == "" {
+		level.Warn(logger).Log("msg", "instance-lock-dir is not set, the first pod leaving the node deregisters the instance for all pods on it")
+	}
 
 	// Graceful shutdown
-	stop := signals.SetupSignalHandler()
+	forceExitSignal, _ := ParseForceExitSignal(app.ForceExitSignal)
+	stop := SetupSignalHandler(forceExitSignal, logger)
 
 	// Setup dependencies
-	svc := setupELBService(logger)
+	sess := setupSession(logger)
+	svc := elbv2.New(sess)
+	ipAddressTypes := NewTargetGroupIPAddressTypes()
+	svc.Handlers.Unmarshal.PushFront(ipAddressTypes.UnmarshalHandler)
 	registratorService := New(svc, logger)
 
-	var err error
-	app.TargetGroupArn, err = discoverTargetGroupArn(app, registratorService)
-	logger = log.With(logger, constants.TargetGroupArn, app.TargetGroupArn)
+	bindings, err := app.TargetBindings()
+	if err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
 
-	// TODO: Fix log context propagation
-	registratorService.Logger = logger
+	if err := renderBindings(app, bindings); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
 
-	if err != nil {
-		logger.Log("error", err)
-		os.Exit(1)
+	if err := resolvePorts(app, bindings); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+
+	if err := discoverTargetGroups(bindings, registratorService, aws.StringValue(svc.Config.Region), app.TargetType, ipAddressTypes, logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+
+	if err := checkAttachments(app, bindings, registratorService, logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
 	}
 
 	ctx := context.Background()
+
+	if err := detectTargetIDs(ctx, app, bindings, logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+	logger = log.With(logger, constants.TargetID, app.TargetID)
+
+	if err := resolveAvailabilityZones(ctx, app, bindings, NewVPCService(ec2.New(sess)), logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+
+	if err := resolveShutdownBudget(ctx, app, bindings, registratorService, logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+
+	if err := deregisterStaleTargets(ctx, app, bindings, registratorService, logger); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(ExitCodeStartupFailed)
+	}
+
+	var kubernetesClient *KubernetesClient
+	if app.NodeWatch.Enabled {
+		if kubernetesClient, err = NewInClusterKubernetesClient(); err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(ExitCodeStartupFailed)
+		}
+	}
+
+	lifecycle := NewLifecycle()
+	lifecycle.Subscribe(LogTransitions(logger))
+	if app.LifecycleHook.Command != "" {
+		lifecycle.Subscribe(app.LifecycleHook.Subscriber(logger))
+	}
+
 	regCancelCtx, regCancelFunc := context.WithCancel(ctx)
+	// Rollbacks of failed registrations aren't cancelled by the signal, they
+	// share the shutdown budget with the deregistration
+	shutdownCtx, shutdownCancel := context.WithCancel(ctx)
+	defer shutdownCancel()
+	if refCount := app.InstanceRefCount(); refCount != nil {
+		go refCount.RunRefresh(regCancelCtx, bindings, lifecycle, logger)
+	}
+
 	// Passing cancellable context in case app.WaitInService is true and we
 	// intentionally sent SIGINT/SIGTERM to the program.
 	// It doesn't make sense to wait for target to be in service when we actually
 	// want to deregister it from target group
-	go registerTarget(regCancelCtx, app, registratorService, logger)
+	regDone := make(chan struct{})
+	go func() {
+		defer close(regDone)
+		registerTargets(regCancelCtx, shutdownCtx, app, bindings, registratorService, ipAddressTypes, lifecycle, logger)
+	}()
+
+	// Spot notices and node disruptions start deregistration before the
+	// signal
+	early := make(chan struct{})
+	var earlyOnce sync.Once
+	deregisterEarly := func(keyvals ...interface{}) {
+		earlyOnce.Do(func() {
+			logger.Log(append([]interface{}{"msg", "Deregistering target early"}, keyvals...)...)
+			close(early)
+		})
+	}
+	if app.SpotNotice.Enabled {
+		go func() {
+			path, notice, err := WaitSpotNotice(regCancelCtx, NewMetadataClient(app.MetadataEndpoint), app.SpotNotice, logger)
+			if err != nil {
+				return
+			}
+			deregisterEarly("reason", "spot notice", "path", path, "notice", notice)
+		}()
+	}
+	if app.NodeWatch.Enabled {
+		go func() {
+			reason, err := WaitNodeDisruption(regCancelCtx, kubernetesClient, app.NodeWatch, logger)
+			if err != nil {
+				return
+			}
+			deregisterEarly("reason", reason, "node", app.NodeWatch.Name)
+		}()
+	}
 
 	// Block and wait for signal
 	logger.Log("msg", "Awaiting signal for deregistration")
-	<-stop
-	// Cancel Register Target operation if case it's running
+	deregisteredEarly := false
+	select {
+	case <-stop:
+	case <-early:
+		deregisteredEarly = true
+	}
+	// The shutdown budget starts now, waiting for registration to stop is
+	// part of it
+	now := time.Now()
+	if deadline, end := app.Shutdown.Split(now, app.PostDeregister.Timeout); !end.IsZero() {
+		timer := time.AfterFunc(deadline.Sub(now), shutdownCancel)
+		defer timer.Stop()
+	}
+	// Stop waiting for the target to be ready, RegisterTargets calls already
+	// sent aren't cancelled
 	regCancelFunc()
+	// Nothing may register the target from now on
+	lifecycle.Shutdown()
+	// Wait for registration, the watchdog and the reconcile loop to stop, so
+	// a RegisterTargets call already sent can't land after the deregistration
+	<-regDone
+
+	// Deregister Target in all Target Groups
+	exitCode := ExitCodeOK
+	if err := deregisterTargets(ctx, now, app, bindings, registratorService, lifecycle, logger); err != nil {
+		exitCode = ExitCodeDeregistrationFailed
+		level.Error(logger).Log("msg", "Failed to deregister target", "exit_code", exitCode, "error", err)
+	}
 
-	// Deregister Target in Target Group
-	deregisterTarget(ctx, app, registratorService, logger)
+	if deregisteredEarly {
+		// Exiting now would restart the container and register the target
+		// again
+		logger.Log("msg", "Target was deregistered early, awaiting signal")
+		<-stop
+	}
+	os.Exit(exitCode)
 }
 
 func setupLogger() log.Logger {
@@ -115,20 +344,102 @@ func setupLogger() log.Logger {
 	return logger
 }
 
-func parseFlags() error {
+func parseFlags(args []string) error {
 	fs, err := gflag.Parse(app)
 	if err != nil {
 		return err
 	}
 
-	err = fs.Parse(os.Args[1:])
+	err = fs.Parse(args)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	switch app.TargetType {
+	case elbv2.TargetTypeEnumIp, elbv2.TargetTypeEnumInstance:
+	default:
+		return fmt.Errorf("unsupported target type %q, expected %q or %q", app.TargetType, elbv2.TargetTypeEnumIp, elbv2.TargetTypeEnumInstance)
+	}
+
+	for _, state := range app.WaitInServiceStates {
+		switch state {
+		case elbv2.TargetHealthStateEnumHealthy, elbv2.TargetHealthStateEnumUnhealthy, elbv2.TargetHealthStateEnumInitial,
+			elbv2.TargetHealthStateEnumUnused, elbv2.TargetHealthStateEnumUnavailable:
+		default:
+			return fmt.Errorf("unsupported wait in service state %q", state)
+		}
+	}
+	// Intervals are used with time.NewTicker which panics on 0, poll loops
+	// would spin
+	intervals := map[string]time.Duration{
+		"wait-in-service-interval":         app.WaitInServiceInterval,
+		"wait-in-service-max-interval":     app.WaitInServiceMaxInterval,
+		"wait-drained-interval":            app.WaitDrainedInterval,
+		"wait-listen-interval":             app.WaitListen.Interval,
+		"connection-drain-interval":        app.ConnectionDrain.Interval,
+		"watchdog-interval":                app.Watchdog.Interval,
+		"spot-notice-interval":             app.SpotNotice.Interval,
+		"attachment-interval":              app.Attachment.Interval,
+		"registration-failure-max-backoff": app.RegistrationFailure.MaxBackoff,
+	}
+	for name, interval := range intervals {
+		if interval <= 0 {
+			return fmt.Errorf("%s has to be positive, got %s", name, interval)
+		}
+	}
+	// A timeout of 0 expires at once, checks and waits would give up
+	// before they start
+	timeouts := map[string]time.Duration{
+		"watchdog-timeout":           app.Watchdog.Timeout,
+		"local-health-check-timeout": app.LocalHealthCheck.Timeout,
+		"wait-listen-timeout":        app.WaitListen.Timeout,
+		"connection-drain-timeout":   app.ConnectionDrain.Timeout,
+	}
+	for name, timeout := range timeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("%s has to be positive, got %s", name, timeout)
+		}
+	}
+	if app.LocalHealthCheck.Interval < 0 {
+		return fmt.Errorf("local-health-check-interval can't be negative, got %s", app.LocalHealthCheck.Interval)
+	}
+	if app.InstanceLockDir != "" && app.InstanceLockTTL <= 0 {
+		return fmt.Errorf("instance-lock-ttl has to be positive")
+	}
+	// Pods holding the instance target have to be told apart
+	if app.TargetType == elbv2.TargetTypeEnumInstance && app.InstanceLockDir != "" && app.Pod.Identity() == "" {
+		return fmt.Errorf("instance-lock-dir requires pod-uid or pod-name and pod-namespace, set POD_UID or POD_NAME and POD_NAMESPACE with Downward API")
+	}
+	if _, err := ParseForceExitSignal(app.ForceExitSignal); err != nil {
+		return err
+	}
+	if err := app.NodeWatch.Validate(); err != nil {
+		return err
+	}
+	if err := app.Attachment.Validate(); err != nil {
+		return err
+	}
+	return app.RegistrationFailure.Validate()
+}
+
+// Journal returns the registration journal, nil when it's not used
+func (a *App) Journal() *RegistrationJournal {
+	if a.JournalDir == "" {
+		return nil
+	}
+	return &RegistrationJournal{Dir: a.JournalDir}
+}
+
+// InstanceRefCount returns reference counter of instance targets shared by
+// pods on the node, nil when it's not used
+func (a *App) InstanceRefCount() *InstanceRefCount {
+	if a.TargetType != elbv2.TargetTypeEnumInstance || a.InstanceLockDir == "" {
+		return nil
+	}
+	return &InstanceRefCount{Dir: a.InstanceLockDir, Holder: a.Pod.Identity(), TTL: a.InstanceLockTTL}
 }
 
-func setupELBService(logger log.Logger) *elbv2.ELBV2 {
+func setupSession(logger log.Logger) *session.Session {
 	var sess *session.Session
 	sessionRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), nil)
 	err := sessionRetrier.Run(func() error {
@@ -139,27 +450,37 @@ func setupELBService(logger log.Logger) *elbv2.ELBV2 {
 
 	if err != nil {
 		level.Error(logger).Log("error", err)
-		os.Exit(1)
+		os.Exit(ExitCodeStartupFailed)
 	}
-	return elbv2.New(sess)
+	return sess
 }
 
-func discoverTargetGroupArn(app *App, registratorService *RegistratorService) (string, error) {
-	var targetGroupArn string
-	discoverTargetGroupArnRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), nil)
-	err := discoverTargetGroupArnRetrier.Run(func() error {
-		var err error
-		targetGroupArn, err = registratorService.DiscoverTargetGroupArn(app.TargetGroupName)
-		return err
-	})
+func detectTargetIDs(ctx context.Context, app *App, bindings Bindings, logger log.Logger) error {
+	targetIDs, source, err := DetectTargetIDs(ctx, app.TargetID, app.TargetType, NewMetadataClient(app.MetadataEndpoint))
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return targetGroupArn, nil
+	if app.VerifyTargetID && app.TargetType == elbv2.TargetTypeEnumIp {
+		for _, targetID := range targetIDs {
+			if err := VerifyLocalAddress(targetID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := assignTargetIDs(bindings, app.TargetType, targetIDs); err != nil {
+		return err
+	}
+
+	logger.Log("msg", "Using target ID", constants.TargetID, targetIDs, "source", source)
+	app.TargetID = targetIDs.String()
+	return nil
 }
 
-func registerTarget(ctx context.Context, app *App, registratorService *RegistratorService, logger log.Logger) {
+// registerTargets registers the target and keeps it registered until ctx is
+// cancelled. Rollbacks of failed registrations run with shutdownCtx.
+func registerTargets(ctx, shutdownCtx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, ipAddressTypes *TargetGroupIPAddressTypes, lifecycle *Lifecycle, logger log.Logger) {
 	if app.PreRegister.Command != "" {
 		preRegCtx, preRegCancelFn := context.WithTimeout(ctx, app.PreRegister.Timeout)
 		defer preRegCancelFn()
@@ -167,18 +488,19 @@ func registerTarget(ctx context.Context, app *App, registratorService *Registrat
 		ExecCommand(preRegCtx, logger, app.PreRegister.Command)
 	}
 
-	registerRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), nil)
-	err := registerRetrier.RunCtx(ctx, func(ctx context.Context) error {
-		return registratorService.RegisterTarget(ctx, &RegisterTargetInput{
-			ID:                        aws.String(app.TargetID),
-			TargetGroupArn:            aws.String(app.TargetGroupArn),
-			WaitUntilInService:        aws.Bool(app.WaitInService),
-			WaitUntilInServiceTimeout: app.WaitInServiceTimeout,
-		})
-	})
-
-	if err != nil {
-		logger.Log("error", err)
+	register := func() error {
+		if app.WaitListen.Port != 0 {
+			if err := WaitListening(ctx, app.WaitListen, logger); err != nil {
+				return err
+			}
+		}
+		if err := waitAttachments(ctx, app, bindings, registratorService, logger); err != nil {
+			return err
+		}
+		return registerBindings(ctx, shutdownCtx, app, bindings, registratorService, lifecycle, logger)
+	}
+	if !registerWithPolicy(ctx, app, register, logger) {
+		return
 	}
 
 	if app.PostRegister.Command != "" {
@@ -188,15 +510,264 @@ func registerTarget(ctx context.Context, app *App, registratorService *Registrat
 		ExecCommand(postRegCtx, logger, app.PostRegister.Command)
 	}
 
+	var wg sync.WaitGroup
+	if app.Watchdog.Check != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunWatchdog(ctx, shutdownCtx, app, bindings, registratorService, lifecycle, logger)
+		}()
+	}
+	if app.Reconcile.Interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunReconcile(ctx, app, bindings, registratorService, ipAddressTypes, lifecycle, logger)
+		}()
+	}
+	wg.Wait()
+}
+
+// registerBindings registers the target in all given target groups in
+// parallel and then waits for it to be in service in all of them.
+// Registration is all or nothing, target groups where the target was
+// registered are rolled back with shutdownCtx if any of the others failed.
+func registerBindings(ctx, shutdownCtx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, lifecycle *Lifecycle, logger log.Logger) error {
+	if err := lifecycle.Transition(StateRegistering, nil); err != nil {
+		return err
+	}
+
+	errs := runBindings(bindings, func(binding *Binding) error {
+		return registerTarget(ctx, app, binding, registratorService.With(binding.LogContext()...))
+	})
+	registered, err := collectErrors(bindings, errs, "Failed to register target", logger)
+
+	if err == nil && app.WaitInService {
+		if err = lifecycle.Transition(StateWaitingHealthy, nil); err == nil {
+			errs = runBindings(bindings, func(binding *Binding) error {
+				return registratorService.With(binding.LogContext()...).WaitUntilTargetInService(ctx, registerTargetInput(app, binding))
+			})
+			_, err = collectErrors(bindings, errs, "Target isn't in service", logger)
+		}
+	}
+
+	if err != nil {
+		if len(registered) > 0 {
+			logger.Log("msg", "Rolling back target registration", "target_groups", registered.String())
+			// The registration context may already be cancelled, rollback
+			// must still go through within the shutdown budget
+			deregisterBindings(shutdownCtx, app, registered, registratorService)
+		}
+		lifecycle.Transition(StateFailed, err)
+		return err
+	}
+	return lifecycle.Transition(StateInService, nil)
+}
+
+// runBindings runs fn for all bindings in parallel and returns their errors
+// in the order of bindings
+func runBindings(bindings Bindings, fn func(*Binding) error) []error {
+	errs := make([]error, len(bindings))
+	var wg sync.WaitGroup
+	for i, binding := range bindings {
+		wg.Add(1)
+		go func(i int, binding *Binding) {
+			defer wg.Done()
+			errs[i] = fn(binding)
+		}(i, binding)
+	}
+	wg.Wait()
+	return errs
+}
+
+// collectErrors logs errors of bindings and returns the bindings without an
+// error and the first error
+func collectErrors(bindings Bindings, errs []error, msg string, logger log.Logger) (Bindings, error) {
+	succeeded := Bindings{}
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			level.Error(log.With(logger, bindings[i].LogContext()...)).Log("msg", msg, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		succeeded = append(succeeded, bindings[i])
+	}
+	return succeeded, firstErr
+}
+
+// registerTarget registers the target in the target group of the binding. When
+// it fails, the instance target is released and the journal entry removed.
+func registerTarget(ctx context.Context, app *App, binding *Binding, registratorService *RegistratorService) (err error) {
+	if refCount := app.InstanceRefCount(); refCount != nil {
+		holders, acquireErr := refCount.Acquire(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port))
+		if acquireErr != nil {
+			return fmt.Errorf("acquiring instance target: %v", acquireErr)
+		}
+		registratorService.Logger.Log("msg", "Acquired instance target", "holders", holders)
+		defer func() {
+			if err != nil {
+				refCount.Release(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port))
+			}
+		}()
+	}
+
+	if app.LocalHealthCheck.Enabled {
+		if err := waitHealthyLocally(ctx, app, binding, registratorService.Logger); err != nil {
+			return err
+		}
+	}
+
+	if journal := app.Journal(); journal != nil {
+		// Recorded before registration, the process may be killed while
+		// RegisterTargets is on the wire
+		if err := journal.Add(binding); err != nil {
+			level.Warn(registratorService.Logger).Log("msg", "Failed to record target in registration journal", "error", err)
+		}
+		defer func() {
+			if err != nil {
+				removeFromJournal(app, binding, registratorService.Logger)
+			}
+		}()
+	}
+
+	return sendRegisterTarget(ctx, app, binding, registratorService)
+}
+
+// registerTargetTimeout bounds RegisterTargets calls with their retries
+const registerTargetTimeout = 30 * time.Second
+
+// sendRegisterTarget calls RegisterTargets with retries. A call on the wire
+// isn't cancelled with ctx, AWS could apply it after the DeregisterTargets
+// which follows the signal, only further retries are skipped.
+func sendRegisterTarget(ctx context.Context, app *App, binding *Binding, registratorService *RegistratorService) error {
+	registerCtx, cancel := context.WithTimeout(context.Background(), registerTargetTimeout)
+	defer cancel()
+
+	registerRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), retrier.BlacklistClassifier{context.Canceled})
+	return registerRetrier.RunCtx(registerCtx, func(registerCtx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return registratorService.RegisterTarget(registerCtx, registerTargetInput(app, binding))
+	})
+}
+
+func registerTargetInput(app *App, binding *Binding) *RegisterTargetInput {
+	return &RegisterTargetInput{
+		ID:                            aws.String(binding.TargetID),
+		Port:                          binding.Port,
+		AvailabilityZone:              optionalString(binding.AvailabilityZone),
+		TargetGroupArn:                aws.String(binding.TargetGroupArn),
+		WaitUntilInServiceTimeout:     app.WaitInServiceTimeout,
+		WaitUntilInServiceInterval:    app.WaitInServiceInterval,
+		WaitUntilInServiceMaxInterval: app.WaitInServiceMaxInterval,
+		WaitUntilInServiceStates:      app.WaitInServiceStates,
+	}
+}
+
+// waitHealthyLocally runs the target group health check against the pod, so
+// a failing or misconfigured health check shows up before registration
+func waitHealthyLocally(ctx context.Context, app *App, binding *Binding, logger log.Logger) error {
+	if binding.TargetGroup == nil {
+		level.Warn(logger).Log("msg", "Target group couldn't be described, skipping local health check")
+		return nil
+	}
+
+	host := binding.TargetID
+	if app.TargetType == elbv2.TargetTypeEnumInstance {
+		host = "127.0.0.1"
+	}
+
+	check, err := NewHealthCheck(binding.TargetGroup, host, binding.Port)
+	if err != nil {
+		return err
+	}
+	return WaitHealthy(ctx, check, app.LocalHealthCheck.Timeout, app.LocalHealthCheck.Interval, logger)
 }
 
-func deregisterTarget(ctx context.Context, app *App, registratorService *RegistratorService, logger log.Logger) {
+// deregisterTargets deregisters the target from all target groups within the
+// shutdown budget starting at now. When deregistration fails, the target
+// transitions to Failed and neither draining nor the post-deregister command
+// run.
+func deregisterTargets(ctx context.Context, now time.Time, app *App, bindings Bindings, registratorService *RegistratorService, lifecycle *Lifecycle, logger log.Logger) error {
+	if lifecycle.State() != StateDraining {
+		if err := lifecycle.Transition(StateDraining, nil); err != nil {
+			level.Warn(logger).Log("error", err)
+		}
+	}
+
+	deregisterCtx, hookCtx := ctx, ctx
+	if deadline, end := app.Shutdown.Split(now, app.PostDeregister.Timeout); !end.IsZero() {
+		var cancel context.CancelFunc
+		deregisterCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		hookCtx, cancel = context.WithDeadline(ctx, end)
+		defer cancel()
+		logger.Log("msg", "Shutdown budget", "deregistration_deadline", deadline.UTC(), "deadline", end.UTC())
+	}
+
+	if err := deregisterBindings(deregisterCtx, app, bindings, registratorService); err != nil {
+		lifecycle.Transition(StateFailed, err)
+		return err
+	}
+
+	var env []string
+	if app.ConnectionDrain.Port != 0 {
+		remaining := WaitConnectionsDrained(deregisterCtx, app.ConnectionDrain, logger)
+		env = append(env, fmt.Sprintf("%s=%d", constants.RemainingConnectionsEnv, remaining))
+	}
+	if deregisterCtx.Err() == context.DeadlineExceeded {
+		level.Warn(logger).Log("msg", "Shutdown budget for deregistration and draining is exhausted")
+	}
+	lifecycle.Transition(StateDeregistered, nil)
+
+	ctx, cancel := context.WithTimeout(hookCtx, app.PostDeregister.Timeout)
+	defer cancel()
+
+	if app.PostDeregister.Command != "" {
+		logger.Log("msg", "Executing post-deregister command", "command", app.PostDeregister.Command)
+		ExecCommand(ctx, logger, app.PostDeregister.Command, env...)
+	}
+	return nil
+}
+
+// deregisterBindings deregisters the target from all given target groups in
+// parallel and returns the first error
+func deregisterBindings(ctx context.Context, app *App, bindings Bindings, registratorService *RegistratorService) error {
+	errs := runBindings(bindings, func(binding *Binding) error {
+		return deregisterTarget(ctx, app, binding, registratorService.With(binding.LogContext()...), app.WaitDrained)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deregisterTarget deregisters the target from the target group of the
+// binding, targets still held by other pods on the node stay registered
+func deregisterTarget(ctx context.Context, app *App, binding *Binding, registratorService *RegistratorService, waitDrained bool) error {
+	logger := registratorService.Logger
+
+	if refCount := app.InstanceRefCount(); refCount != nil {
+		holders, err := refCount.Release(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port))
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to release instance target, deregistering anyway", "error", err)
+		} else if holders > 0 {
+			logger.Log("msg", "Instance target is still used by other pods on the node, skipping deregistration", "holders", holders)
+			removeFromJournal(app, binding, logger)
+			return nil
+		}
+	}
+
+	input := deregisterTargetInput(binding)
 	deregisterRetrier := retrier.New(retrier.ExponentialBackoff(3, 1*time.Second), nil)
 	err := deregisterRetrier.RunCtx(ctx, func(context.Context) error {
-		err := registratorService.DeregisterTarget(ctx, &DeregisterTargetInput{
-			ID:             aws.String(app.TargetID),
-			TargetGroupArn: aws.String(app.TargetGroupArn),
-		})
+		err := registratorService.DeregisterTarget(ctx, input)
 		if err != nil {
 			level.Error(logger).Log("error", err)
 		}
@@ -205,13 +776,65 @@ func deregisterTarget(ctx context.Context, app *App, registratorService *Registr
 
 	if err != nil {
 		logger.Log("error", err)
+		return err
+	}
+	removeFromJournal(app, binding, logger)
+
+	if waitDrained {
+		waitTargetDrained(ctx, app, input, registratorService)
+	}
+	return nil
+}
+
+func removeFromJournal(app *App, binding *Binding, logger log.Logger) {
+	if journal := app.Journal(); journal != nil {
+		if err := journal.Remove(binding); err != nil {
+			level.Warn(logger).Log("msg", "Failed to remove target from registration journal", "error", err)
+		}
 	}
+}
+
+func deregisterTargetInput(binding *Binding) *DeregisterTargetInput {
+	return &DeregisterTargetInput{
+		ID:               aws.String(binding.TargetID),
+		Port:             binding.Port,
+		AvailabilityZone: optionalString(binding.AvailabilityZone),
+		TargetGroupArn:   aws.String(binding.TargetGroupArn),
+	}
+}
 
-	ctx, cancel := context.WithTimeout(ctx, app.PostDeregister.Timeout)
+// waitTargetDrained waits until the load balancer stops sending traffic to
+// the target, at most for the deregistration delay of the target group
+func waitTargetDrained(ctx context.Context, app *App, input *DeregisterTargetInput, registratorService *RegistratorService) {
+	logger := registratorService.Logger
+
+	delay, err := registratorService.DeregistrationDelay(ctx, aws.StringValue(input.TargetGroupArn))
+	if err != nil {
+		level.Warn(logger).Log("msg", "Unable to read deregistration delay, using default", "default", DefaultDeregistrationDelay, "error", err)
+		delay = DefaultDeregistrationDelay
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, delay)
 	defer cancel()
 
-	if app.PostDeregister.Command != "" {
-		logger.Log("msg", "Executing post-deregister command", "command", app.PostDeregister.Command)
-		ExecCommand(ctx, logger, app.PostDeregister.Command)
+	logger.Log("msg", "Waiting for target to be drained", "deregistration_delay", delay)
+	err = registratorService.WaitUntilTargetDrained(drainCtx, input, app.WaitDrainedInterval)
+	switch {
+	case err == nil:
+	case ctx.Err() == context.DeadlineExceeded:
+		level.Warn(logger).Log("msg", "Shutdown budget expired before target was reported as drained")
+	case drainCtx.Err() == context.DeadlineExceeded:
+		logger.Log("msg", "Deregistration delay expired before target was reported as drained")
+	default:
+		level.Error(logger).Log("msg", "Failed to wait for target to be drained", "error", err)
+	}
+}
+
+// optionalString returns nil for empty strings, so optional API fields are
+// left out of requests
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
 	}
+	return aws.String(value)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TCP socket states as reported in /proc/net/tcp
+const (
+	tcpStateEstablished = 0x01
+	tcpStateListen      = 0x0A
+)
+
+// procNetDir lists sockets of the network namespace of the process, which a
+// sidecar shares with the other containers of the pod
+const procNetDir = "/proc/net"
+
+type TCPSocket struct {
+	LocalIP    net.IP
+	LocalPort  int
+	RemoteIP   net.IP
+	RemotePort int
+	State      int
+}
+
+// ReadTCPSockets reads IPv4 and IPv6 TCP sockets from tcp and tcp6 files in
+// dir, a missing tcp6 file means IPv6 is disabled
+func ReadTCPSockets(dir string) ([]TCPSocket, error) {
+	var sockets []TCPSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		s, err := readTCPSocketsFile(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) && name == "tcp6" {
+				continue
+			}
+			return nil, err
+		}
+		sockets = append(sockets, s...)
+	}
+	return sockets, nil
+}
+
+// readTCPSocketsFile parses lines like
+//
+//	sl  local_address rem_address   st tx_queue rx_queue ...
+//	 0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 ...
+func readTCPSocketsFile(path string) ([]TCPSocket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sockets []TCPSocket
+	scanner := bufio.NewScanner(f)
+	// Skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		localIP, localPort, err := parseProcAddress(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		remoteIP, remotePort, err := parseProcAddress(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		state, err := strconv.ParseInt(fields[3], 16, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid state %q", path, fields[3])
+		}
+
+		sockets = append(sockets, TCPSocket{
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			State:      int(state),
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcAddress parses hex encoded address and port, the address is
+// stored as 32-bit words in host byte order, which is little endian on all
+// platforms EKS runs on
+func parseProcAddress(value string) (net.IP, int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", value)
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", value)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in address %q", value)
+	}
+	return net.IP(raw), int(port), nil
+}
+
+// CountEstablished returns count of established connections to the local
+// port, connections from loopback don't come through the load balancer and
+// aren't counted
+func CountEstablished(sockets []TCPSocket, port int) int {
+	count := 0
+	for _, socket := range sockets {
+		if socket.State == tcpStateEstablished && socket.LocalPort == port && !socket.RemoteIP.IsLoopback() {
+			count++
+		}
+	}
+	return count
+}
+
+// IsListening reports whether there is a socket listening on the local port
+func IsListening(sockets []TCPSocket, port int) bool {
+	for _, socket := range sockets {
+		if socket.State == tcpStateListen && socket.LocalPort == port {
+			return true
+		}
+	}
+	return false
+}
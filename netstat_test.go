@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20381 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20375 1 0000000000000000 100 0 0 10 0
+   2: 0A01A8C0:1F90 0500000A:D431 01 00000000:00000000 00:00000000 00000000     0        0 21533 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:1F90 0100007F:A2F4 01 00000000:00000000 00:00000000 00000000     0        0 21601 1 0000000000000000 20 4 30 10 -1
+   4: 0A01A8C0:1F90 0600000A:D433 06 00000000:00000000 03:00000CC3 00000000     0        0 0 3 0000000000000000
+`
+	testProcNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:2384 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20390 1 0000000000000000 100 0 0 10 0
+   1: 0000000000000000FFFF00000A01A8C0:1F90 0000000000000000FFFF00000700000A:C350 01 00000000:00000000 00:00000000 00000000     0        0 21720 1 0000000000000000 20 4 30 10 -1
+   2: 0000000000000000FFFF00000100007F:1F90 0000000000000000FFFF00000100007F:C352 01 00000000:00000000 00:00000000 00000000     0        0 21722 1 0000000000000000 20 4 30 10 -1
+   3: B80D0120000000000000000001000000:2384 B80D0120000000000000000002000000:E0F2 01 00000000:00000000 00:00000000 00000000     0        0 21730 1 0000000000000000 20 4 30 10 -1
+`
+)
+
+func TestParseProcAddress(t *testing.T) {
+	tests := []struct {
+		value string
+		ip    string
+		port  int
+		err   bool
+	}{
+		{value: "0100007F:1F90", ip: "127.0.0.1", port: 8080},
+		{value: "0A01A8C0:1F90", ip: "192.168.1.10", port: 8080},
+		{value: "00000000:0000", ip: "0.0.0.0", port: 0},
+		{value: "00000000000000000000000001000000:0050", ip: "::1", port: 80},
+		{value: "0000000000000000FFFF00000100007F:1F90", ip: "127.0.0.1", port: 8080},
+		{value: "B80D0120000000000000000001000000:2384", ip: "2001:db8::1", port: 9092},
+		{value: "0100007F", err: true},
+		{value: "0100007:1F90", err: true},
+		{value: "0100007F00:1F90", err: true},
+		{value: "0100007F:1F90F", err: true},
+		{value: "XX00007F:1F90", err: true},
+	}
+	for _, tt := range tests {
+		ip, port, err := parseProcAddress(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseProcAddress(%q) = %s, %d, want error", tt.value, ip, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseProcAddress(%q): %v", tt.value, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+			t.Errorf("parseProcAddress(%q) = %s, %d, want %s, %d", tt.value, ip, port, tt.ip, tt.port)
+		}
+	}
+}
+
+func testProcNetDir(t *testing.T, tcp6 bool) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tcp"), []byte(testProcNetTCP), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tcp6 {
+		if err := ioutil.WriteFile(filepath.Join(dir, "tcp6"), []byte(testProcNetTCP6), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestReadTCPSockets(t *testing.T) {
+	dir, done := testProcNetDir(t, true)
+	defer done()
+
+	sockets, err := ReadTCPSockets(dir)
+	if err != nil {
+		t.Fatalf("ReadTCPSockets: %v", err)
+	}
+	if len(sockets) != 9 {
+		t.Fatalf("ReadTCPSockets returned %d sockets, want 9", len(sockets))
+	}
+	want := TCPSocket{LocalIP: net.ParseIP("192.168.1.10"), LocalPort: 8080, RemoteIP: net.ParseIP("10.0.0.5"), RemotePort: 54321, State: tcpStateEstablished}
+	if got := sockets[2]; !got.LocalIP.Equal(want.LocalIP) || got.LocalPort != want.LocalPort ||
+		!got.RemoteIP.Equal(want.RemoteIP) || got.RemotePort != want.RemotePort || got.State != want.State {
+		t.Errorf("socket = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadTCPSocketsWithoutIPv6(t *testing.T) {
+	dir, done := testProcNetDir(t, false)
+	defer done()
+
+	sockets, err := ReadTCPSockets(dir)
+	if err != nil {
+		t.Fatalf("ReadTCPSockets: %v", err)
+	}
+	if len(sockets) != 5 {
+		t.Errorf("ReadTCPSockets returned %d sockets, want 5", len(sockets))
+	}
+}
+
+func TestCountEstablished(t *testing.T) {
+	dir, done := testProcNetDir(t, true)
+	defer done()
+	sockets, err := ReadTCPSockets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		port  int
+		count int
+	}{
+		// One IPv4 and one v4-mapped IPv6 connection, connections from
+		// loopback and in TIME_WAIT aren't counted
+		{port: 8080, count: 2},
+		{port: 9092, count: 1},
+		{port: 3306, count: 0},
+	}
+	for _, tt := range tests {
+		if count := CountEstablished(sockets, tt.port); count != tt.count {
+			t.Errorf("CountEstablished(%d) = %d, want %d", tt.port, count, tt.count)
+		}
+	}
+}
+
+func TestIsListening(t *testing.T) {
+	dir, done := testProcNetDir(t, true)
+	defer done()
+	sockets, err := ReadTCPSockets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		port      int
+		listening bool
+	}{
+		{port: 8080, listening: true},
+		// Listening on loopback or IPv6 only counts as well
+		{port: 3306, listening: true},
+		{port: 9092, listening: true},
+		// Remote ports of connections don't count
+		{port: 54321, listening: false},
+		{port: 9090, listening: false},
+	}
+	for _, tt := range tests {
+		if listening := IsListening(sockets, tt.port); listening != tt.listening {
+			t.Errorf("IsListening(%d) = %t, want %t", tt.port, listening, tt.listening)
+		}
+	}
+}
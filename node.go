@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// nodeWatchRetryInterval is the wait before reading the node again after
+// a failed or closed watch
+var nodeWatchRetryInterval = 5 * time.Second
+
+// NodeClient reads and watches nodes, it's implemented by KubernetesClient
+type NodeClient interface {
+	GetNode(ctx context.Context, name string) (*Node, error)
+	WatchNode(ctx context.Context, name, resourceVersion string, fn func(*Node) bool) error
+}
+
+// NodeWatch watches the node of the pod for signs of an upcoming eviction,
+// so the target leaves the load balancer before the pod gets SIGTERM
+type NodeWatch struct {
+	Enabled       bool     `desc:"Whether to deregister target early when the node is cordoned or tainted for disruption, requires get and watch permission on nodes"`
+	Name          string   `desc:"Node of the pod, defaults to NODE_NAME environment variable"`
+	Unschedulable bool     `desc:"Whether a cordoned node deregisters target early"`
+	Taints        []string `desc:"Taint keys which deregister target early, can be repeated"`
+}
+
+func (w *NodeWatch) Validate() error {
+	if w.Enabled && w.Name == "" {
+		return fmt.Errorf("node watch requires node name, set NODE_NAME from spec.nodeName with Downward API")
+	}
+	return nil
+}
+
+// disruption explains why the node is about to be drained, it's empty when
+// it isn't
+func (w *NodeWatch) disruption(node *Node) string {
+	if w.Unschedulable && node.Spec.Unschedulable {
+		return "node is cordoned"
+	}
+	for _, taint := range node.Spec.Taints {
+		for _, key := range w.Taints {
+			if taint.Key == key {
+				return fmt.Sprintf("node has taint %s:%s", taint.Key, taint.Effect)
+			}
+		}
+	}
+	return ""
+}
+
+// WaitNodeDisruption watches the node until it is cordoned or gets one of
+// the disruption taints and returns the reason
+func WaitNodeDisruption(ctx context.Context, client NodeClient, nodeWatch *NodeWatch, logger log.Logger) (string, error) {
+	logger = log.With(logger, "node", nodeWatch.Name)
+	logger.Log("msg", "Watching node for disruption")
+	for {
+		node, err := client.GetNode(ctx, nodeWatch.Name)
+		if err == nil {
+			if reason := nodeWatch.disruption(node); reason != "" {
+				return reason, nil
+			}
+
+			var reason string
+			err = client.WatchNode(ctx, nodeWatch.Name, node.Metadata.ResourceVersion, func(node *Node) bool {
+				reason = nodeWatch.disruption(node)
+				return reason == ""
+			})
+			if reason != "" {
+				return reason, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil && err != io.EOF {
+			level.Warn(logger).Log("msg", "Failed to watch node", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(nodeWatchRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testNode(t *testing.T, resourceVersion, spec string) *Node {
+	t.Helper()
+	node := &Node{}
+	if err := json.Unmarshal([]byte(`{"metadata": {"name": "node-1", "resourceVersion": "`+resourceVersion+`"}, "spec": `+spec+`}`), node); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// fakeWatch is one watch of the node, it sends nodes and then ends with err
+type fakeWatch struct {
+	nodes []*Node
+	err   error
+}
+
+// fakeNodeClient returns node from GetNode and runs watches in order, once
+// they are used up watches block until the context is done
+type fakeNodeClient struct {
+	mu      sync.Mutex
+	node    *Node
+	getErr  error
+	watches []fakeWatch
+
+	gets             int
+	resourceVersions []string
+}
+
+func (c *fakeNodeClient) GetNode(ctx context.Context, name string) (*Node, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	if c.getErr != nil {
+		err := c.getErr
+		c.getErr = nil
+		return nil, err
+	}
+	return c.node, nil
+}
+
+func (c *fakeNodeClient) WatchNode(ctx context.Context, name, resourceVersion string, fn func(*Node) bool) error {
+	c.mu.Lock()
+	c.resourceVersions = append(c.resourceVersions, resourceVersion)
+	if len(c.watches) == 0 {
+		c.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	watch := c.watches[0]
+	c.watches = c.watches[1:]
+	c.mu.Unlock()
+
+	for _, node := range watch.nodes {
+		c.mu.Lock()
+		// The next read of the node returns the latest version
+		c.node = node
+		c.mu.Unlock()
+		if !fn(node) {
+			return nil
+		}
+	}
+	return watch.err
+}
+
+func TestWaitNodeDisruption(t *testing.T) {
+	defer func(interval time.Duration) { nodeWatchRetryInterval = interval }(nodeWatchRetryInterval)
+	nodeWatchRetryInterval = time.Millisecond
+
+	nodeWatch := &NodeWatch{
+		Enabled:       true,
+		Name:          "node-1",
+		Unschedulable: true,
+		Taints:        []string{"ToBeDeletedByClusterAutoscaler"},
+	}
+
+	tests := []struct {
+		name   string
+		client *fakeNodeClient
+		reason string
+		gets   int
+	}{
+		{
+			name:   "cordoned before watch",
+			client: &fakeNodeClient{node: testNode(t, "1", `{"unschedulable": true}`)},
+			reason: "node is cordoned",
+			gets:   1,
+		},
+		{
+			name: "cordoned during watch",
+			client: &fakeNodeClient{
+				node: testNode(t, "1", `{}`),
+				watches: []fakeWatch{{nodes: []*Node{
+					testNode(t, "2", `{"taints": [{"key": "node.kubernetes.io/not-ready", "effect": "NoExecute"}]}`),
+					testNode(t, "3", `{"unschedulable": true}`),
+				}}},
+			},
+			reason: "node is cordoned",
+			gets:   1,
+		},
+		{
+			name: "tainted during watch",
+			client: &fakeNodeClient{
+				node: testNode(t, "1", `{}`),
+				watches: []fakeWatch{{nodes: []*Node{
+					testNode(t, "2", `{"taints": [{"key": "ToBeDeletedByClusterAutoscaler", "value": "1600000000", "effect": "NoSchedule"}]}`),
+				}}},
+			},
+			reason: "node has taint ToBeDeletedByClusterAutoscaler:NoSchedule",
+			gets:   1,
+		},
+		{
+			name: "watch closed by API server",
+			client: &fakeNodeClient{
+				node: testNode(t, "1", `{}`),
+				watches: []fakeWatch{
+					{nodes: []*Node{testNode(t, "2", `{}`)}, err: io.EOF},
+					{nodes: []*Node{testNode(t, "3", `{"unschedulable": true}`)}},
+				},
+			},
+			reason: "node is cordoned",
+			gets:   2,
+		},
+		{
+			name: "watch error event",
+			client: &fakeNodeClient{
+				node: testNode(t, "1", `{}`),
+				watches: []fakeWatch{
+					{err: errors.New(`watch of node node-1 failed: {"kind": "Status", "code": 410, "reason": "Expired"}`)},
+					{nodes: []*Node{testNode(t, "2", `{"unschedulable": true}`)}},
+				},
+			},
+			reason: "node is cordoned",
+			gets:   2,
+		},
+		{
+			name: "get failed",
+			client: &fakeNodeClient{
+				node:   testNode(t, "1", `{"unschedulable": true}`),
+				getErr: errors.New("connection refused"),
+			},
+			reason: "node is cordoned",
+			gets:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			reason, err := WaitNodeDisruption(ctx, tt.client, nodeWatch, log.NewNopLogger())
+			if err != nil {
+				t.Fatalf("WaitNodeDisruption: %v", err)
+			}
+			if reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+			if tt.client.gets != tt.gets {
+				t.Errorf("node read %d times, want %d", tt.client.gets, tt.gets)
+			}
+		})
+	}
+}
+
+func TestWaitNodeDisruptionReconnectResourceVersion(t *testing.T) {
+	defer func(interval time.Duration) { nodeWatchRetryInterval = interval }(nodeWatchRetryInterval)
+	nodeWatchRetryInterval = time.Millisecond
+
+	client := &fakeNodeClient{
+		node: testNode(t, "1", `{}`),
+		watches: []fakeWatch{
+			{nodes: []*Node{testNode(t, "5", `{}`)}, err: io.EOF},
+			{nodes: []*Node{testNode(t, "6", `{"unschedulable": true}`)}},
+		},
+	}
+	nodeWatch := &NodeWatch{Enabled: true, Name: "node-1", Unschedulable: true}
+	if _, err := WaitNodeDisruption(context.Background(), client, nodeWatch, log.NewNopLogger()); err != nil {
+		t.Fatalf("WaitNodeDisruption: %v", err)
+	}
+
+	// The node is read again after the watch closed, the new watch starts
+	// from its version
+	want := []string{"1", "5"}
+	if len(client.resourceVersions) != len(want) {
+		t.Fatalf("watched from versions %v, want %v", client.resourceVersions, want)
+	}
+	for i := range want {
+		if client.resourceVersions[i] != want[i] {
+			t.Errorf("watched from versions %v, want %v", client.resourceVersions, want)
+		}
+	}
+}
+
+func TestWaitNodeDisruptionIgnored(t *testing.T) {
+	// Cordons aren't watched and the taint isn't one of the watched ones
+	client := &fakeNodeClient{
+		node: testNode(t, "1", `{"unschedulable": true}`),
+		watches: []fakeWatch{{nodes: []*Node{
+			testNode(t, "2", `{"unschedulable": true, "taints": [{"key": "node.kubernetes.io/unreachable", "effect": "NoExecute"}]}`),
+		}}},
+	}
+	nodeWatch := &NodeWatch{Enabled: true, Name: "node-1", Taints: []string{"ToBeDeletedByClusterAutoscaler"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	reason, err := WaitNodeDisruption(ctx, client, nodeWatch, log.NewNopLogger())
+	if err != context.DeadlineExceeded {
+		t.Errorf("WaitNodeDisruption = %q, %v, want %v", reason, err, context.DeadlineExceeded)
+	}
+}
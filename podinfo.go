@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PodInfo struct {
+	Name            string `desc:"Pod name, defaults to POD_NAME environment variable"`
+	Namespace       string `desc:"Pod namespace, defaults to POD_NAMESPACE environment variable"`
+	UID             string `desc:"Pod UID, defaults to POD_UID environment variable"`
+	LabelsFile      string `desc:"Path to pod labels projected with Downward API"`
+	AnnotationsFile string `desc:"Path to pod annotations projected with Downward API, used to resolve named ports"`
+}
+
+// NamedPorts maps named container ports to port numbers
+type NamedPorts map[string]int64
+
+// ReadDownwardAPIFile reads labels or annotations projected into a file
+// with the Kubernetes Downward API. Each line is in key="value" format
+// where the value is a quoted string.
+func ReadDownwardAPIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed value of %q: %v", path, parts[0], err)
+		}
+		values[parts[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// NamedPortsFromAnnotations collects named ports from pod annotations.
+// Downward API doesn't expose container ports, so they have to be
+// repeated as annotations, e.g. k8s-nlb-registrator-sidecar/port-kafka: "9092"
+func NamedPortsFromAnnotations(annotations map[string]string) (NamedPorts, error) {
+	namedPorts := NamedPorts{}
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, constants.NamedPortAnnotationPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, constants.NamedPortAnnotationPrefix)
+		port, _, err := ParsePort(value)
+		if err != nil || port == nil {
+			return nil, fmt.Errorf("annotation %s has invalid port %q", key, value)
+		}
+		namedPorts[name] = *port
+	}
+	return namedPorts, nil
+}
+
+// NamedPorts reads named ports from the annotations file, if it is set
+func (p *PodInfo) NamedPorts() (NamedPorts, error) {
+	if p.AnnotationsFile == "" {
+		return NamedPorts{}, nil
+	}
+	annotations, err := ReadDownwardAPIFile(p.AnnotationsFile)
+	if err != nil {
+		return nil, err
+	}
+	return NamedPortsFromAnnotations(annotations)
+}
+
+// TerminationGracePeriod reads the termination grace period from the
+// annotations file, it's 0 when it isn't annotated
+func (p *PodInfo) TerminationGracePeriod() (time.Duration, error) {
+	if p.AnnotationsFile == "" {
+		return 0, nil
+	}
+	annotations, err := ReadDownwardAPIFile(p.AnnotationsFile)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := annotations[constants.TerminationGracePeriodAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("annotation %s has invalid value %q", constants.TerminationGracePeriodAnnotation, value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Identity returns the pod UID, or namespace/name without it. It's empty
+// when neither is set, the hostname isn't unique for hostNetwork pods.
+func (p *PodInfo) Identity() string {
+	if p.UID != "" {
+		return p.UID
+	}
+	if p.Namespace != "" && p.Name != "" {
+		return p.Namespace + "/" + p.Name
+	}
+	return ""
+}
+
+// Metadata collects pod metadata used to render templates
+func (p *PodInfo) Metadata() (*PodMetadata, error) {
+	metadata := &PodMetadata{
+		Name:        p.Name,
+		Namespace:   p.Namespace,
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+	}
+
+	var err error
+	if p.LabelsFile != "" {
+		if metadata.Labels, err = ReadDownwardAPIFile(p.LabelsFile); err != nil {
+			return nil, err
+		}
+	}
+	if p.AnnotationsFile != "" {
+		if metadata.Annotations, err = ReadDownwardAPIFile(p.AnnotationsFile); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
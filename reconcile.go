@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"k8s-nlb-registrator-sidecar/constants"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type Reconcile struct {
+	Interval time.Duration `desc:"How often to check that target is still registered and target group wasn't replaced, 0 disables the reconcile loop"`
+	Jitter   float64       `desc:"Fraction of the interval added randomly to every wait, spreads API calls of many pods"`
+}
+
+// RunReconcile repairs drift until ctx is cancelled, which happens before
+// deregistration starts. Target groups replaced by IaC are discovered again
+// and targets removed from a target group are registered again. Repairs run
+// while the target is in service, so they can't undo the fencing by the
+// watchdog.
+func RunReconcile(ctx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, ipAddressTypes *TargetGroupIPAddressTypes, lifecycle *Lifecycle, logger log.Logger) {
+	logger.Log("msg", "Starting reconcile loop", "interval", app.Reconcile.Interval)
+	for {
+		wait := app.Reconcile.Interval + time.Duration(rand.Float64()*app.Reconcile.Jitter*float64(app.Reconcile.Interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		for _, binding := range bindings {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Discovery only reads the selector of the binding, which
+			// doesn't change, so it runs outside of the lifecycle
+			var discovered *elbv2.TargetGroup
+			if binding.Discovered {
+				var err error
+				if discovered, err = discoverTargetGroup(binding, registratorService); err != nil {
+					level.Error(log.With(logger, binding.LogContext()...)).Log("msg", "Failed to discover target group", "error", err)
+					continue
+				}
+			}
+
+			// The watchdog may keep the target deregistered
+			lifecycle.WhileInService(func() {
+				reconcileBinding(ctx, app, binding, discovered, registratorService.With(binding.LogContext()...), ipAddressTypes, lifecycle)
+			})
+		}
+	}
+}
+
+// reconcileRegisterTimeout bounds registering the target again, leaving
+// service waits for it
+const reconcileRegisterTimeout = 10 * time.Second
+
+// reconcileBinding has to run in Lifecycle.WhileInService, it changes the
+// target group of the binding
+func reconcileBinding(ctx context.Context, app *App, binding *Binding, discovered *elbv2.TargetGroup, registratorService *RegistratorService, ipAddressTypes *TargetGroupIPAddressTypes, lifecycle *Lifecycle) {
+	logger := registratorService.Logger
+
+	if discovered != nil {
+		if targetGroupArn := aws.StringValue(discovered.TargetGroupArn); targetGroupArn != binding.TargetGroupArn {
+			if err := validateTargetGroup(discovered, app.TargetType); err != nil {
+				level.Error(logger).Log("msg", "Discovered target group is invalid", "error", err)
+				return
+			}
+			if ipAddressType := ipAddressTypes.Get(targetGroupArn); ipAddressType != binding.IPAddressType {
+				level.Error(logger).Log("msg", "Discovered target group has different IP address type", constants.TargetGroupArn, targetGroupArn, "ip_address_type", ipAddressType)
+				return
+			}
+
+			logger.Log("msg", "Target group was replaced", "new_target_group_arn", targetGroupArn)
+			replaceTargetGroup(ctx, app, binding, discovered, registratorService, lifecycle)
+			registratorService = registratorService.With(constants.TargetGroupArn, targetGroupArn)
+		}
+	}
+
+	health, err := registratorService.TargetHealth(ctx, deregisterTargetInput(binding))
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to describe target health", "error", err)
+		return
+	}
+
+	state := aws.StringValue(health.State)
+	if state != elbv2.TargetHealthStateEnumUnused && state != elbv2.TargetHealthStateEnumDraining {
+		return
+	}
+
+	// The cleanup subcommand, e.g. from a preStop hook, deregisters the
+	// target and removes it from the journal before the signal arrives
+	if journal := app.Journal(); journal != nil {
+		recorded, err := journal.Contains(binding)
+		if err != nil {
+			level.Error(registratorService.Logger).Log("msg", "Failed to read registration journal", "error", err)
+			return
+		}
+		if !recorded {
+			registratorService.Logger.Log("msg", "Target was removed from registration journal, not registering it again", "state", state)
+			return
+		}
+	}
+
+	registratorService.Logger.Log("msg", "Target is missing in target group, registering it again", "state", state, "reason", aws.StringValue(health.Reason))
+	// Not cancelled with ctx, the call could land after the deregistration.
+	// The next run retries failed registrations.
+	registerCtx, cancel := context.WithTimeout(context.Background(), reconcileRegisterTimeout)
+	defer cancel()
+	if err := registratorService.RegisterTarget(registerCtx, registerTargetInput(app, binding)); err != nil {
+		level.Error(registratorService.Logger).Log("msg", "Failed to register target again", "error", err)
+	}
+}
+
+// replaceTargetGroup moves the binding to the discovered target group, the
+// instance target hold and the journal entry move with it
+func replaceTargetGroup(ctx context.Context, app *App, binding *Binding, discovered *elbv2.TargetGroup, registratorService *RegistratorService, lifecycle *Lifecycle) {
+	logger := registratorService.Logger
+	targetGroupArn := aws.StringValue(discovered.TargetGroupArn)
+
+	deregister := true
+	refCount := app.InstanceRefCount()
+	if refCount != nil {
+		holders, err := refCount.Release(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port))
+		if err != nil {
+			level.Warn(logger).Log("msg", "Failed to release instance target of replaced target group", "error", err)
+		}
+		deregister = err != nil || holders == 0
+	}
+	// The old target group is most likely gone, deregistration is best
+	// effort
+	if deregister {
+		if err := registratorService.DeregisterTarget(ctx, deregisterTargetInput(binding)); err != nil {
+			level.Warn(logger).Log("msg", "Failed to deregister target from replaced target group", "error", err)
+		}
+	}
+	removeFromJournal(app, binding, logger)
+
+	lifecycle.Do(func(State) {
+		binding.TargetGroup = discovered
+		binding.TargetGroupArn = targetGroupArn
+	})
+
+	logger = log.With(logger, constants.TargetGroupArn, targetGroupArn)
+	if refCount != nil {
+		if _, err := refCount.Acquire(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port)); err != nil {
+			level.Warn(logger).Log("msg", "Failed to acquire instance target", "error", err)
+		}
+	}
+	if journal := app.Journal(); journal != nil {
+		if err := journal.Add(binding); err != nil {
+			level.Warn(logger).Log("msg", "Failed to record target in registration journal", "error", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// InstanceRefCount reference counts pods on a node sharing the same instance
+// target, so the instance is deregistered only when the last of them leaves.
+// Holders are kept in a file per target in a node-local directory, e.g. a
+// hostPath volume, and the file is locked while it is updated.
+// Holders refresh their timestamp while they run, holders which weren't
+// refreshed within TTL were killed without releasing the target and are
+// pruned.
+type InstanceRefCount struct {
+	Dir    string
+	Holder string
+	TTL    time.Duration
+}
+
+// Acquire adds holder to the target and returns the count of holders
+func (c *InstanceRefCount) Acquire(targetGroupArn, targetID string, port int64) (int, error) {
+	return c.update(targetGroupArn, targetID, port, func(holders map[string]time.Time) {
+		holders[c.Holder] = time.Now()
+	})
+}
+
+// Refresh updates timestamp of the holder if it holds the target
+func (c *InstanceRefCount) Refresh(targetGroupArn, targetID string, port int64) (int, error) {
+	return c.update(targetGroupArn, targetID, port, func(holders map[string]time.Time) {
+		if _, ok := holders[c.Holder]; ok {
+			holders[c.Holder] = time.Now()
+		}
+	})
+}
+
+// Release removes holder from the target and returns the count of holders
+// left
+func (c *InstanceRefCount) Release(targetGroupArn, targetID string, port int64) (int, error) {
+	return c.update(targetGroupArn, targetID, port, func(holders map[string]time.Time) {
+		delete(holders, c.Holder)
+	})
+}
+
+// RunRefresh refreshes the holder of all bindings until ctx is cancelled,
+// bindings are read in the lifecycle as the reconcile loop may change them
+func (c *InstanceRefCount) RunRefresh(ctx context.Context, bindings Bindings, lifecycle *Lifecycle, logger log.Logger) {
+	ticker := time.NewTicker(c.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lifecycle.Do(func(State) {
+			for _, binding := range bindings {
+				if _, err := c.Refresh(binding.TargetGroupArn, binding.TargetID, aws.Int64Value(binding.Port)); err != nil {
+					level.Warn(log.With(logger, binding.LogContext()...)).Log("msg", "Failed to refresh instance target holder", "error", err)
+				}
+			}
+		})
+	}
+}
+
+func (c *InstanceRefCount) path(targetGroupArn, targetID string, port int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d", targetGroupArn, targetID, port)))
+	return filepath.Join(c.Dir, fmt.Sprintf("%s-%d-%s", targetID, port, hex.EncodeToString(sum[:8])))
+}
+
+func (c *InstanceRefCount) update(targetGroupArn, targetID string, port int64, fn func(map[string]time.Time)) (int, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(c.path(targetGroupArn, targetID, port), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	now := time.Now()
+	holders := map[string]time.Time{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// <holder> <unix timestamp>, holders written without timestamp
+		// get the current time and expire unless they refresh
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		refreshed := now
+		if len(fields) > 1 {
+			if seconds, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				refreshed = time.Unix(seconds, 0)
+			}
+		}
+		if c.TTL > 0 && now.Sub(refreshed) > c.TTL {
+			continue
+		}
+		holders[fields[0]] = refreshed
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	fn(holders)
+
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	for holder, refreshed := range holders {
+		if _, err := fmt.Fprintln(f, holder, refreshed.Unix()); err != nil {
+			return 0, err
+		}
+	}
+	return len(holders), f.Sync()
+}
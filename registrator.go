@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,16 +14,34 @@ import (
 	"github.com/go-kit/kit/log"
 )
 
+const (
+	describeTagsBatchSize = 20
+
+	deregistrationDelayAttribute = "deregistration_delay.timeout_seconds"
+	// DefaultDeregistrationDelay is used by target groups unless configured
+	DefaultDeregistrationDelay = 300 * time.Second
+)
+
 type RegisterTargetInput struct {
 	ID                        *string
+	Port                      *int64
+	AvailabilityZone          *string
 	TargetGroupArn            *string
-	WaitUntilInService        *bool
 	WaitUntilInServiceTimeout time.Duration
+	// WaitUntilInServiceInterval is the first poll interval, it doubles up
+	// to WaitUntilInServiceMaxInterval
+	WaitUntilInServiceInterval    time.Duration
+	WaitUntilInServiceMaxInterval time.Duration
+	// WaitUntilInServiceStates are target health states counted as in
+	// service, healthy when empty
+	WaitUntilInServiceStates []string
 }
 
 type DeregisterTargetInput struct {
-	ID             *string
-	TargetGroupArn *string
+	ID               *string
+	Port             *int64
+	AvailabilityZone *string
+	TargetGroupArn   *string
 }
 
 type Registrator interface {
@@ -34,10 +54,12 @@ type RegistratorService struct {
 	Logger    log.Logger
 }
 
-func NewTargets(targetID *string) []*elbv2.TargetDescription {
+func NewTargets(targetID *string, port *int64, availabilityZone *string) []*elbv2.TargetDescription {
 	return []*elbv2.TargetDescription{
 		&elbv2.TargetDescription{
-			Id: targetID,
+			Id:               targetID,
+			Port:             port,
+			AvailabilityZone: availabilityZone,
 		},
 	}
 }
@@ -49,7 +71,7 @@ func (r *RegistratorService) RegisterTarget(ctx context.Context, t *RegisterTarg
 	}
 
 	r.Logger.Log("msg", "Registering target in target group")
-	targets := NewTargets(t.ID)
+	targets := NewTargets(t.ID, t.Port, t.AvailabilityZone)
 	_, err := r.ELBClient.RegisterTargetsWithContext(ctx, &elbv2.RegisterTargetsInput{
 		Targets:        targets,
 		TargetGroupArn: t.TargetGroupArn,
@@ -59,20 +81,6 @@ func (r *RegistratorService) RegisterTarget(ctx context.Context, t *RegisterTarg
 		return err
 	}
 
-	if aws.BoolValue(t.WaitUntilInService) {
-		ctx, cancel := context.WithTimeout(ctx, t.WaitUntilInServiceTimeout)
-		defer cancel()
-
-		r.Logger.Log("msg", "Waiting for target to be in service in target group")
-		err = r.ELBClient.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
-			TargetGroupArn: t.TargetGroupArn,
-			Targets:        targets,
-		})
-		if err != nil {
-			return err
-		}
-	}
-
 	r.Logger.Log("msg", "Target is registered in target group")
 
 	return nil
@@ -82,7 +90,7 @@ func (r *RegistratorService) DeregisterTarget(ctx context.Context, t *Deregister
 	r.Logger.Log("msg", "Deregistering target from target group")
 	_, err := r.ELBClient.DeregisterTargetsWithContext(ctx, &elbv2.DeregisterTargetsInput{
 		TargetGroupArn: t.TargetGroupArn,
-		Targets:        NewTargets(t.ID),
+		Targets:        NewTargets(t.ID, t.Port, t.AvailabilityZone),
 	})
 	if err != nil {
 		return err
@@ -91,7 +99,90 @@ func (r *RegistratorService) DeregisterTarget(ctx context.Context, t *Deregister
 	return nil
 }
 
+// DeregistrationDelay returns how long the load balancer keeps draining
+// deregistered targets of the target group
+func (r *RegistratorService) DeregistrationDelay(ctx context.Context, targetGroupArn string) (time.Duration, error) {
+	out, err := r.ELBClient.DescribeTargetGroupAttributesWithContext(ctx, &elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, attribute := range out.Attributes {
+		if aws.StringValue(attribute.Key) != deregistrationDelayAttribute {
+			continue
+		}
+		seconds, err := strconv.Atoi(aws.StringValue(attribute.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s attribute %q", deregistrationDelayAttribute, aws.StringValue(attribute.Value))
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return DefaultDeregistrationDelay, nil
+}
+
+// TargetHealth returns health of the target in the target group, targets
+// which aren't registered are reported as unused with reason
+// Target.NotRegistered
+func (r *RegistratorService) TargetHealth(ctx context.Context, t *DeregisterTargetInput) (*elbv2.TargetHealth, error) {
+	out, err := r.ELBClient.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: t.TargetGroupArn,
+		Targets:        NewTargets(t.ID, t.Port, t.AvailabilityZone),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, description := range out.TargetHealthDescriptions {
+		if description.TargetHealth != nil {
+			return description.TargetHealth, nil
+		}
+	}
+	return &elbv2.TargetHealth{
+		State:  aws.String(elbv2.TargetHealthStateEnumUnused),
+		Reason: aws.String(elbv2.TargetHealthReasonEnumTargetNotRegistered),
+	}, nil
+}
+
+// WaitUntilTargetDrained polls target health until the target is unused,
+// which is the case when the load balancer finished draining it
+func (r *RegistratorService) WaitUntilTargetDrained(ctx context.Context, t *DeregisterTargetInput, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	for {
+		health, err := r.TargetHealth(ctx, t)
+		if err != nil {
+			return err
+		}
+
+		state := aws.StringValue(health.State)
+		if state == elbv2.TargetHealthStateEnumUnused {
+			r.Logger.Log("msg", "Target is drained", "elapsed", time.Since(started).Round(time.Second))
+			return nil
+		}
+		r.Logger.Log("msg", "Target is still draining", "state", state, "elapsed", time.Since(started).Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 func (r *RegistratorService) DiscoverTargetGroupArn(targetGroupName string) (string, error) {
+	targetGroup, err := r.DiscoverTargetGroup(targetGroupName)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(targetGroup.TargetGroupArn), nil
+}
+
+// DiscoverTargetGroup returns the target group with the given name
+func (r *RegistratorService) DiscoverTargetGroup(targetGroupName string) (*elbv2.TargetGroup, error) {
 	targetGroups, err := r.ELBClient.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
 		Names: []*string{
 			aws.String(targetGroupName),
@@ -99,14 +190,187 @@ func (r *RegistratorService) DiscoverTargetGroupArn(targetGroupName string) (str
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(targetGroups.TargetGroups) != 1 {
-		return "", fmt.Errorf("Unexpected count of target groups %d", len(targetGroups.TargetGroups))
+		return nil, fmt.Errorf("Unexpected count of target groups %d", len(targetGroups.TargetGroups))
 	}
 
-	return aws.StringValue(targetGroups.TargetGroups[0].TargetGroupArn), nil
+	return targetGroups.TargetGroups[0], nil
+}
+
+// DescribeTargetGroup returns the target group with the given ARN
+func (r *RegistratorService) DescribeTargetGroup(targetGroupArn string) (*elbv2.TargetGroup, error) {
+	targetGroups, err := r.ELBClient.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{
+			aws.String(targetGroupArn),
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targetGroups.TargetGroups) != 1 {
+		return nil, fmt.Errorf("Unexpected count of target groups %d", len(targetGroups.TargetGroups))
+	}
+
+	return targetGroups.TargetGroups[0], nil
+}
+
+// With returns a copy of the service which logs with additional context
+func (r *RegistratorService) With(keyvals ...interface{}) *RegistratorService {
+	return New(r.ELBClient, log.With(r.Logger, keyvals...))
+}
+
+// DiscoverTargetGroupByTags returns the only target group which has all
+// given tags
+func (r *RegistratorService) DiscoverTargetGroupByTags(tags map[string]string) (*elbv2.TargetGroup, error) {
+	var candidates []*string
+	targetGroups := map[string]*elbv2.TargetGroup{}
+	err := r.ELBClient.DescribeTargetGroupsPages(&elbv2.DescribeTargetGroupsInput{}, func(page *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
+		for _, targetGroup := range page.TargetGroups {
+			candidates = append(candidates, targetGroup.TargetGroupArn)
+			targetGroups[aws.StringValue(targetGroup.TargetGroupArn)] = targetGroup
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	// DescribeTags accepts at most 20 resources at once
+	for start := 0; start < len(candidates); start += describeTagsBatchSize {
+		end := start + describeTagsBatchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+
+		out, err := r.ELBClient.DescribeTags(&elbv2.DescribeTagsInput{
+			ResourceArns: candidates[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, description := range out.TagDescriptions {
+			if matchTags(description.Tags, tags) {
+				matches = append(matches, aws.StringValue(description.ResourceArn))
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No target group matches tags %s", FormatTagSelector(tags))
+	case 1:
+		return targetGroups[matches[0]], nil
+	default:
+		return nil, fmt.Errorf("Tags %s match %d target groups, expected exactly one: %s", FormatTagSelector(tags), len(matches), strings.Join(matches, ", "))
+	}
+}
+
+// DescribeLoadBalancers returns load balancers with the given ARNs
+func (r *RegistratorService) DescribeLoadBalancers(loadBalancerArns []*string) ([]*elbv2.LoadBalancer, error) {
+	loadBalancers, err := r.ELBClient.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: loadBalancerArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loadBalancers.LoadBalancers, nil
+}
+
+// DiscoverTargetGroupByListener returns the target group the default action
+// of the load balancer listener forwards to
+func (r *RegistratorService) DiscoverTargetGroupByListener(loadBalancerName string, listenerPort int64) (*elbv2.TargetGroup, error) {
+	loadBalancers, err := r.ELBClient.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		Names: []*string{
+			aws.String(loadBalancerName),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(loadBalancers.LoadBalancers) != 1 {
+		return nil, fmt.Errorf("Unexpected count of load balancers %d", len(loadBalancers.LoadBalancers))
+	}
+
+	var listener *elbv2.Listener
+	err = r.ELBClient.DescribeListenersPages(&elbv2.DescribeListenersInput{
+		LoadBalancerArn: loadBalancers.LoadBalancers[0].LoadBalancerArn,
+	}, func(page *elbv2.DescribeListenersOutput, lastPage bool) bool {
+		for _, l := range page.Listeners {
+			if aws.Int64Value(l.Port) == listenerPort {
+				listener = l
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if listener == nil {
+		return nil, fmt.Errorf("Load balancer %s has no listener on port %d", loadBalancerName, listenerPort)
+	}
+
+	for _, action := range listener.DefaultActions {
+		if aws.StringValue(action.Type) != elbv2.ActionTypeEnumForward {
+			continue
+		}
+		targetGroupArn, err := forwardActionTargetGroupArn(action)
+		if err != nil {
+			return nil, err
+		}
+		return r.DescribeTargetGroup(targetGroupArn)
+	}
+
+	return nil, fmt.Errorf("Listener %s:%d has no default forward action", loadBalancerName, listenerPort)
+}
+
+// forwardActionTargetGroupArn returns the target group of a forward action.
+// Weighted forward actions are accepted as long as only one of the target
+// groups receives traffic, e.g. after IaC shifted all weight to a replacement.
+func forwardActionTargetGroupArn(action *elbv2.Action) (string, error) {
+	if action.ForwardConfig == nil || len(action.ForwardConfig.TargetGroups) == 0 {
+		if action.TargetGroupArn == nil {
+			return "", errors.New("Forward action has no target group")
+		}
+		return aws.StringValue(action.TargetGroupArn), nil
+	}
+
+	var weighted []string
+	for _, tuple := range action.ForwardConfig.TargetGroups {
+		// Weight defaults to 1 if it isn't set
+		if tuple.Weight != nil && aws.Int64Value(tuple.Weight) == 0 {
+			continue
+		}
+		weighted = append(weighted, aws.StringValue(tuple.TargetGroupArn))
+	}
+
+	if len(weighted) != 1 {
+		return "", fmt.Errorf("Forward action sends traffic to %d target groups, expected exactly one: %s", len(weighted), strings.Join(weighted, ", "))
+	}
+	return weighted[0], nil
+}
+
+func matchTags(tags []*elbv2.Tag, selector map[string]string) bool {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		values[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	for key, value := range selector {
+		if v, ok := values[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
 }
 
 func New(elbClient elbv2iface.ELBV2API, logger log.Logger) *RegistratorService {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestForwardActionTargetGroupArn(t *testing.T) {
+	const (
+		blue  = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/blue/73e2d6bc24d8a067"
+		green = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/green/83e2d6bc24d8a068"
+	)
+	tuple := func(arn string, weight *int64) *elbv2.TargetGroupTuple {
+		return &elbv2.TargetGroupTuple{TargetGroupArn: aws.String(arn), Weight: weight}
+	}
+
+	tests := []struct {
+		name   string
+		action *elbv2.Action
+		arn    string
+		err    bool
+	}{
+		{
+			name:   "target group",
+			action: &elbv2.Action{TargetGroupArn: aws.String(blue)},
+			arn:    blue,
+		},
+		{
+			name:   "forward config",
+			action: &elbv2.Action{ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{tuple(blue, nil)}}},
+			arn:    blue,
+		},
+		{
+			name: "all weight shifted",
+			action: &elbv2.Action{ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+				tuple(blue, aws.Int64(0)), tuple(green, aws.Int64(100)),
+			}}},
+			arn: green,
+		},
+		{
+			name: "weighted",
+			action: &elbv2.Action{ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+				tuple(blue, aws.Int64(50)), tuple(green, aws.Int64(50)),
+			}}},
+			err: true,
+		},
+		{
+			name: "default weight",
+			action: &elbv2.Action{ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+				tuple(blue, nil), tuple(green, nil),
+			}}},
+			err: true,
+		},
+		{
+			name: "no weight",
+			action: &elbv2.Action{ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+				tuple(blue, aws.Int64(0)),
+			}}},
+			err: true,
+		},
+		{
+			name:   "no target group",
+			action: &elbv2.Action{},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		arn, err := forwardActionTargetGroupArn(tt.action)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: forwardActionTargetGroupArn = %q, want error", tt.name, arn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: forwardActionTargetGroupArn: %v", tt.name, err)
+			continue
+		}
+		if arn != tt.arn {
+			t.Errorf("%s: forwardActionTargetGroupArn = %q, want %q", tt.name, arn, tt.arn)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ShutdownBudget limits how long deregistration, draining and the
+// post-deregister command may take after the signal, so they finish before
+// the kubelet kills the container
+type ShutdownBudget struct {
+	Timeout time.Duration `desc:"Total time for deregistration, draining and post-deregister command after the signal, read from the k8s-nlb-registrator-sidecar/termination-grace-period-seconds pod annotation when 0, unlimited without the annotation"`
+	Reserve time.Duration `desc:"Part of the termination grace period left for the kubelet and the application, only used with the annotation"`
+}
+
+// Split divides the budget starting at now. Deregistration and draining get
+// the budget except the post-deregister command timeout, which is capped at
+// half of the budget. The command may run until the end of the budget.
+// Zero times are returned when the budget is unlimited.
+func (s *ShutdownBudget) Split(now time.Time, hookTimeout time.Duration) (time.Time, time.Time) {
+	if s.Timeout <= 0 {
+		return time.Time{}, time.Time{}
+	}
+	if hookTimeout > s.Timeout/2 {
+		hookTimeout = s.Timeout / 2
+	}
+	end := now.Add(s.Timeout)
+	return end.Add(-hookTimeout), end
+}
+
+// resolveShutdownBudget reads the budget from the termination grace period
+// when it isn't set and warns about target groups which drain for longer
+// than the budget
+func resolveShutdownBudget(ctx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, logger log.Logger) error {
+	if app.Shutdown.Timeout == 0 {
+		gracePeriod, err := app.Pod.TerminationGracePeriod()
+		if err != nil {
+			return err
+		}
+		if gracePeriod == 0 {
+			return nil
+		}
+		if app.Shutdown.Timeout = gracePeriod - app.Shutdown.Reserve; app.Shutdown.Timeout <= 0 {
+			level.Warn(logger).Log("msg", "Termination grace period is shorter than the shutdown reserve, shutdown is unlimited", "termination_grace_period", gracePeriod, "reserve", app.Shutdown.Reserve)
+			app.Shutdown.Timeout = 0
+			return nil
+		}
+	}
+	logger.Log("msg", "Using shutdown budget", "budget", app.Shutdown.Timeout)
+
+	for _, binding := range bindings {
+		logger := log.With(logger, binding.LogContext()...)
+		delay, err := registratorService.DeregistrationDelay(ctx, binding.TargetGroupArn)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Unable to read deregistration delay", "error", err)
+			continue
+		}
+		if delay > app.Shutdown.Timeout {
+			level.Warn(logger).Log("msg", "Deregistration delay of target group exceeds shutdown budget, connections may be cut before the target is drained", "deregistration_delay", delay, "budget", app.Shutdown.Timeout)
+		}
+	}
+	return nil
+}
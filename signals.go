@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// shutdownSignals start deregistration
+var shutdownSignals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+
+// forceExitSignals can be configured as the force exit signal
+var forceExitSignals = map[string]os.Signal{
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// ParseForceExitSignal parses signal name with or without the SIG prefix,
+// empty name disables force exit
+func ParseForceExitSignal(name string) (os.Signal, error) {
+	if name == "" {
+		return nil, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := forceExitSignals[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported force exit signal %q, expected one of SIGQUIT, SIGHUP, SIGUSR1 or SIGUSR2", name)
+	}
+	return sig, nil
+}
+
+// SetupSignalHandler returns a channel which is closed on SIGTERM or SIGINT.
+// Unlike the controller-runtime handler, repeated signals don't exit the
+// process in the middle of deregistration, they are only logged. The force
+// exit signal exits immediately.
+func SetupSignalHandler(forceExit os.Signal, logger log.Logger) <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signals := shutdownSignals
+	if forceExit != nil {
+		signals = append(signals, forceExit)
+	}
+	signal.Notify(c, signals...)
+
+	go func() {
+		stopping := false
+		for sig := range c {
+			switch {
+			case sig == forceExit:
+				level.Warn(logger).Log("msg", "Received force exit signal, exiting without deregistration", "signal", sig, "exit_code", ExitCodeForceExit)
+				os.Exit(ExitCodeForceExit)
+			case !stopping:
+				logger.Log("msg", "Received signal", "signal", sig)
+				stopping = true
+				close(stop)
+			default:
+				level.Warn(logger).Log("msg", "Ignoring repeated signal, deregistration is in progress", "signal", sig)
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	spotInstanceActionPath      = "spot/instance-action"
+	rebalanceRecommendationPath = "events/recommendations/rebalance"
+)
+
+// SpotNotice watches instance metadata for spot interruption notices and
+// rebalance recommendations. Spot nodes may be gone before the pod gets
+// SIGTERM, the notice gives at least two minutes to drain the target.
+type SpotNotice struct {
+	Enabled   bool          `desc:"Whether to deregister target early when the node gets a spot interruption notice, requires IMDS access from the pod"`
+	Rebalance bool          `desc:"Whether rebalance recommendations deregister target early as well, the target isn't registered again when no interruption follows"`
+	Interval  time.Duration `desc:"How often to poll instance metadata for spot notices"`
+}
+
+// WaitSpotNotice polls instance metadata until a spot interruption notice
+// or a rebalance recommendation appears and returns its reason and content
+func WaitSpotNotice(ctx context.Context, client *MetadataClient, spot *SpotNotice, logger log.Logger) (string, string, error) {
+	paths := []string{spotInstanceActionPath}
+	if spot.Rebalance {
+		paths = append(paths, rebalanceRecommendationPath)
+	}
+
+	logger.Log("msg", "Watching instance metadata for spot notices", "paths", len(paths))
+	ticker := time.NewTicker(spot.Interval)
+	defer ticker.Stop()
+	for {
+		for _, path := range paths {
+			notice, err := client.Get(ctx, path)
+			if err == nil {
+				return path, notice, nil
+			}
+			if _, ok := err.(*ErrMetadataNotFound); !ok && ctx.Err() == nil {
+				level.Warn(logger).Log("msg", "Failed to read instance metadata", "path", path, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
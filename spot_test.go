@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const testToken = "test-token"
+
+// fakeIMDS serves metadata paths, requests without the session token are
+// rejected unless IMDSv1 is allowed
+type fakeIMDS struct {
+	mu       sync.Mutex
+	v1       bool
+	metadata map[string]string
+	tokens   int
+	gets     int
+}
+
+func (f *fakeIMDS) set(path, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.metadata[path] = value
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == imdsTokenPath {
+		if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		if f.v1 {
+			// IMDSv2 disabled, e.g. by an older metadata proxy
+			http.NotFound(w, r)
+			return
+		}
+		f.tokens++
+		w.Write([]byte(testToken))
+		return
+	}
+
+	if !f.v1 && r.Header.Get("X-aws-ec2-metadata-token") != testToken {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+	f.gets++
+	value, ok := f.metadata[r.URL.Path[len(imdsMetadataPath):]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(value + "\n"))
+}
+
+func newFakeIMDS(v1 bool) (*fakeIMDS, *MetadataClient, func()) {
+	imds := &fakeIMDS{v1: v1, metadata: map[string]string{}}
+	server := httptest.NewServer(imds)
+	return imds, NewMetadataClient(server.URL + "/"), server.Close
+}
+
+func TestMetadataClientSessionToken(t *testing.T) {
+	imds, client, done := newFakeIMDS(false)
+	defer done()
+	imds.set("instance-id", "i-0123456789abcdef0")
+
+	for i := 0; i < 2; i++ {
+		id, err := client.Get(context.Background(), "instance-id")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if id != "i-0123456789abcdef0" {
+			t.Errorf("Get = %q, want i-0123456789abcdef0", id)
+		}
+	}
+	if imds.tokens != 1 {
+		t.Errorf("requested %d tokens, want the token to be cached", imds.tokens)
+	}
+}
+
+func TestMetadataClientIMDSv1Fallback(t *testing.T) {
+	imds, client, done := newFakeIMDS(true)
+	defer done()
+	imds.set("instance-id", "i-0123456789abcdef0")
+
+	id, err := client.Get(context.Background(), "instance-id")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if id != "i-0123456789abcdef0" {
+		t.Errorf("Get = %q, want i-0123456789abcdef0", id)
+	}
+}
+
+func TestMetadataClientNotFound(t *testing.T) {
+	_, client, done := newFakeIMDS(false)
+	defer done()
+
+	_, err := client.Get(context.Background(), spotInstanceActionPath)
+	notFound, ok := err.(*ErrMetadataNotFound)
+	if !ok {
+		t.Fatalf("Get error = %v, want ErrMetadataNotFound", err)
+	}
+	if notFound.Path != spotInstanceActionPath {
+		t.Errorf("ErrMetadataNotFound.Path = %q, want %q", notFound.Path, spotInstanceActionPath)
+	}
+}
+
+func TestWaitSpotNotice(t *testing.T) {
+	const notice = `{"action": "terminate", "time": "2017-09-18T08:22:00Z"}`
+
+	tests := []struct {
+		name      string
+		v1        bool
+		rebalance bool
+		path      string
+	}{
+		{name: "instance action", path: spotInstanceActionPath},
+		{name: "instance action IMDSv1", v1: true, path: spotInstanceActionPath},
+		{name: "rebalance recommendation", rebalance: true, path: rebalanceRecommendationPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imds, client, done := newFakeIMDS(tt.v1)
+			defer done()
+
+			// The notice appears after a few polls returned 404
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				imds.set(tt.path, notice)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			spot := &SpotNotice{Enabled: true, Rebalance: tt.rebalance, Interval: 10 * time.Millisecond}
+			path, got, err := WaitSpotNotice(ctx, client, spot, log.NewNopLogger())
+			if err != nil {
+				t.Fatalf("WaitSpotNotice: %v", err)
+			}
+			if path != tt.path {
+				t.Errorf("path = %q, want %q", path, tt.path)
+			}
+			if got != notice {
+				t.Errorf("notice = %q, want %q", got, notice)
+			}
+			imds.mu.Lock()
+			defer imds.mu.Unlock()
+			if imds.gets < 2 {
+				t.Errorf("metadata read %d times, want polling until the notice appears", imds.gets)
+			}
+		})
+	}
+}
+
+func TestWaitSpotNoticeCancel(t *testing.T) {
+	_, client, done := newFakeIMDS(false)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	spot := &SpotNotice{Enabled: true, Interval: 10 * time.Millisecond}
+	if _, _, err := WaitSpotNotice(ctx, client, spot, log.NewNopLogger()); err != context.DeadlineExceeded {
+		t.Errorf("WaitSpotNotice error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
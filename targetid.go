@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+const (
+	targetIDSourceFlag      = "flag"
+	targetIDSourceEnv       = "env"
+	targetIDSourceInterface = "interface"
+	targetIDSourceMetadata  = "instance-metadata"
+)
+
+// TargetIDs holds target IDs by IP address type, dual-stack pods have one
+// for each of ipv4 and ipv6
+type TargetIDs map[string]string
+
+func (t TargetIDs) String() string {
+	ids := make([]string, 0, len(t))
+	for _, id := range t {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// ParseTargetIDs parses comma separated IP addresses, at most one per
+// address family
+func ParseTargetIDs(value string) (TargetIDs, error) {
+	targetIDs := TargetIDs{}
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		ip := net.ParseIP(id)
+		if ip == nil {
+			return nil, fmt.Errorf("target ID %q is not an IP address", id)
+		}
+		ipAddressType := ipAddressType(ip)
+		if _, ok := targetIDs[ipAddressType]; ok {
+			return nil, fmt.Errorf("target IDs %q have more than one %s address", value, ipAddressType)
+		}
+		targetIDs[ipAddressType] = ip.String()
+	}
+	return targetIDs, nil
+}
+
+// DetectTargetIDs returns target IDs and where they were taken from. They
+// are taken in the following order:
+//  1. targetID given explicitly, comma separated for dual-stack pods
+//  2. instance ID from EC2 instance metadata for instance target groups
+//  3. POD_IPS or POD_IP environment variables, usually set from Downward API
+//     status.podIPs and status.podIP
+//  4. addresses of the primary non-loopback interface
+//
+// Instance IDs are returned under an empty IP address type.
+func DetectTargetIDs(ctx context.Context, targetID, targetType string, metadata *MetadataClient) (TargetIDs, string, error) {
+	if targetType == elbv2.TargetTypeEnumInstance {
+		if targetID != "" {
+			return TargetIDs{"": targetID}, targetIDSourceFlag, nil
+		}
+		instanceID, err := metadata.Get(ctx, "instance-id")
+		if err != nil {
+			return nil, "", fmt.Errorf("reading instance ID from instance metadata: %v", err)
+		}
+		return TargetIDs{"": instanceID}, targetIDSourceMetadata, nil
+	}
+
+	if targetID != "" {
+		targetIDs, err := ParseTargetIDs(targetID)
+		return targetIDs, targetIDSourceFlag, err
+	}
+
+	for _, env := range []string{"POD_IPS", "POD_IP"} {
+		if podIPs := os.Getenv(env); podIPs != "" {
+			targetIDs, err := ParseTargetIDs(podIPs)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: %v", env, err)
+			}
+			return targetIDs, targetIDSourceEnv, nil
+		}
+	}
+
+	targetIDs, err := primaryInterfaceAddresses()
+	if err != nil {
+		return nil, "", err
+	}
+	return targetIDs, targetIDSourceInterface, nil
+}
+
+// primaryInterfaceAddresses returns the first global unicast address of each
+// family of the first interface which is up and isn't a loopback, in a pod
+// that's eth0
+func primaryInterfaceAddresses() (TargetIDs, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		targetIDs := TargetIDs{}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if _, ok := targetIDs[ipAddressType(ipNet.IP)]; !ok {
+				targetIDs[ipAddressType(ipNet.IP)] = ipNet.IP.String()
+			}
+		}
+		if len(targetIDs) > 0 {
+			return targetIDs, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface with a global unicast address found")
+}
+
+// VerifyLocalAddress checks that the IP is assigned to a local interface, so
+// a misconfigured target ID can't register an IP of another pod
+func VerifyLocalAddress(targetID string) error {
+	ip := net.ParseIP(targetID)
+	if ip == nil {
+		return fmt.Errorf("target ID %q is not an IP address", targetID)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("target ID %s is not assigned to any local interface", targetID)
+}
+
+// assignTargetIDs picks the target ID of each binding by the IP address type
+// of its target group
+func assignTargetIDs(bindings Bindings, targetType string, targetIDs TargetIDs) error {
+	for _, binding := range bindings {
+		if targetType == elbv2.TargetTypeEnumInstance {
+			binding.TargetID = targetIDs[""]
+			continue
+		}
+
+		targetID, ok := targetIDs[binding.IPAddressType]
+		if !ok {
+			return fmt.Errorf("target group %s has IP address type %s, but there is no %s target ID among %s", binding.TargetGroupArn, binding.IPAddressType, binding.IPAddressType, targetIDs)
+		}
+		binding.TargetID = targetID
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// PodMetadata is the data available in templates
+type PodMetadata struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// StatefulSetOrdinal returns the ordinal of a StatefulSet pod, which is the
+// suffix of the pod name, e.g. 3 for kafka-3
+func (m *PodMetadata) StatefulSetOrdinal() (int, error) {
+	i := strings.LastIndex(m.Name, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("pod name %q has no StatefulSet ordinal", m.Name)
+	}
+	ordinal, err := strconv.Atoi(m.Name[i+1:])
+	if err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("pod name %q has no StatefulSet ordinal", m.Name)
+	}
+	return ordinal, nil
+}
+
+var templateFuncs = template.FuncMap{
+	// env returns value of an environment variable, e.g. one set from
+	// Downward API fieldRef
+	"env": os.Getenv,
+	// file returns content of a file, e.g. one projected with Downward API
+	"file": func(path string) (string, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	},
+	"trunc":   truncate,
+	"hash":    hash,
+	"shorten": shorten,
+	"lower":   strings.ToLower,
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+}
+
+// truncate returns first n characters of s
+func truncate(n int, s string) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// hash returns first n characters of hex encoded SHA-256 of s
+func hash(n int, s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return truncate(n, hex.EncodeToString(sum[:]))
+}
+
+// shorten keeps s as is when it fits into n characters, otherwise it is
+// truncated and suffixed with its hash to stay unique
+func shorten(n int, s string) string {
+	const hashLen = 8
+	if len(s) <= n || n <= hashLen {
+		return truncate(n, s)
+	}
+	return strings.TrimRight(truncate(n-hashLen-1, s), "-") + "-" + hash(hashLen, s)
+}
+
+// RenderTemplate renders text as Go template with pod metadata,
+// e.g. {{.Namespace}}-{{.StatefulSetOrdinal}}-tg or
+// {{printf "%s-%s" .Namespace .Name | shorten 32}}
+func RenderTemplate(text string, metadata *PodMetadata) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, metadata); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestShorten(t *testing.T) {
+	const long = "kafka-production-broker-external-tg"
+	tests := []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{n: 32, s: "kafka-3-tg", want: "kafka-3-tg"},
+		{n: 10, s: "kafka-3-tg", want: "kafka-3-tg"},
+		{n: 32, s: long, want: "kafka-production-broker-" + hash(8, long)},
+		// The hyphen at the cut isn't doubled
+		{n: 26, s: long, want: "kafka-production-" + hash(8, long)},
+		// No room for the hash, s is only truncated
+		{n: 8, s: long, want: "kafka-pr"},
+	}
+	for _, tt := range tests {
+		got := shorten(tt.n, tt.s)
+		if got != tt.want {
+			t.Errorf("shorten(%d, %q) = %q, want %q", tt.n, tt.s, got, tt.want)
+		}
+		if len(got) > tt.n {
+			t.Errorf("shorten(%d, %q) = %q, longer than %d", tt.n, tt.s, got, tt.n)
+		}
+	}
+
+	// Names sharing the prefix stay unique
+	a, b := shorten(32, long+"-a"), shorten(32, long+"-b")
+	if a == b {
+		t.Errorf("shorten(32, ...) = %q for different names", a)
+	}
+}
+
+func TestRenderTemplateShorten(t *testing.T) {
+	metadata := &PodMetadata{Name: "broker-external-3", Namespace: "kafka-production"}
+	got, err := RenderTemplate(`{{printf "%s-%s" .Namespace .Name | shorten 32}}`, metadata)
+	if err != nil {
+		t.Fatalf("RenderTemplate: %v", err)
+	}
+	if want := "kafka-production-broker-" + hash(8, "kafka-production-broker-external-3"); got != want {
+		t.Errorf("RenderTemplate = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log/level"
+)
+
+// targetHealthHints explain the usual causes of target health reasons
+var targetHealthHints = map[string]string{
+	elbv2.TargetHealthReasonEnumElbRegistrationInProgress:  "the load balancer is still registering the target",
+	elbv2.TargetHealthReasonEnumElbInitialHealthChecking:   "the target hasn't passed enough health checks yet, consider a longer -wait-in-service-timeout",
+	elbv2.TargetHealthReasonEnumTargetResponseCodeMismatch: "the health check returned an unexpected HTTP code, check the health check path and matcher",
+	elbv2.TargetHealthReasonEnumTargetTimeout:              "the health check timed out, check that security groups allow the load balancer to reach the target port",
+	elbv2.TargetHealthReasonEnumTargetFailedHealthChecks:   "the target doesn't accept health check connections",
+	elbv2.TargetHealthReasonEnumTargetNotRegistered:        "the target was deregistered meanwhile",
+	elbv2.TargetHealthReasonEnumTargetNotInUse:             "the target group isn't used by a load balancer or the availability zone of the target isn't enabled",
+	elbv2.TargetHealthReasonEnumTargetInvalidState:         "the instance is stopped or terminated",
+	elbv2.TargetHealthReasonEnumTargetIpUnusable:           "the target IP is in use by a load balancer",
+	elbv2.TargetHealthReasonEnumElbInternalError:           "the health check failed inside the load balancer",
+}
+
+// WaitUntilTargetInService polls target health until the target reaches one
+// of the success states, healthy by default. Every change of the state is
+// logged with the reason reported by the load balancer, the poll interval
+// doubles up to the max interval. A diagnostic summary is returned when the
+// target isn't in service within the timeout.
+func (r *RegistratorService) WaitUntilTargetInService(ctx context.Context, t *RegisterTargetInput) error {
+	ctx, cancel := context.WithTimeout(ctx, t.WaitUntilInServiceTimeout)
+	defer cancel()
+
+	states := t.WaitUntilInServiceStates
+	if len(states) == 0 {
+		states = []string{elbv2.TargetHealthStateEnumHealthy}
+	}
+	target := &DeregisterTargetInput{
+		ID:               t.ID,
+		Port:             t.Port,
+		AvailabilityZone: t.AvailabilityZone,
+		TargetGroupArn:   t.TargetGroupArn,
+	}
+
+	r.Logger.Log("msg", "Waiting for target to be in service in target group", "states", strings.Join(states, ","))
+	interval := t.WaitUntilInServiceInterval
+	started := time.Now()
+	polls := 0
+	var last *elbv2.TargetHealth
+	var history []string
+	for {
+		health, err := r.TargetHealth(ctx, target)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				break
+			}
+			return err
+		}
+		polls++
+
+		if last == nil || aws.StringValue(last.State) != aws.StringValue(health.State) || aws.StringValue(last.Reason) != aws.StringValue(health.Reason) {
+			elapsed := time.Since(started).Round(time.Second)
+			r.Logger.Log("msg", "Target health changed", "state", aws.StringValue(health.State), "reason", aws.StringValue(health.Reason), "description", aws.StringValue(health.Description), "elapsed", elapsed)
+			history = append(history, fmt.Sprintf("%s after %s", formatTargetHealth(health), elapsed))
+		}
+		last = health
+
+		for _, state := range states {
+			if aws.StringValue(health.State) == state {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if interval *= 2; interval > t.WaitUntilInServiceMaxInterval {
+			interval = t.WaitUntilInServiceMaxInterval
+		}
+	}
+
+	keyvals := []interface{}{"msg", "Target isn't in service", "timeout", t.WaitUntilInServiceTimeout, "polls", polls, "history", strings.Join(history, " -> ")}
+	if last != nil {
+		keyvals = append(keyvals, "state", aws.StringValue(last.State), "reason", aws.StringValue(last.Reason), "description", aws.StringValue(last.Description))
+		if hint, ok := targetHealthHints[aws.StringValue(last.Reason)]; ok {
+			keyvals = append(keyvals, "hint", hint)
+		}
+	}
+	level.Error(r.Logger).Log(keyvals...)
+
+	if last == nil {
+		return fmt.Errorf("target health wasn't described within %s", t.WaitUntilInServiceTimeout)
+	}
+	return fmt.Errorf("target isn't in service after %s, last target health %s", t.WaitUntilInServiceTimeout, formatTargetHealth(last))
+}
+
+func formatTargetHealth(health *elbv2.TargetHealth) string {
+	if health.Reason == nil {
+		return aws.StringValue(health.State)
+	}
+	return fmt.Sprintf("%s (%s)", aws.StringValue(health.State), aws.StringValue(health.Reason))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s-nlb-registrator-sidecar/constants"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	watchdogStateRegistered   = "registered"
+	watchdogStateDeregistered = "deregistered"
+
+	execCheckPrefix = "exec:"
+)
+
+type Watchdog struct {
+	Check            string        `desc:"Local check run after target is registered, tcp://host:port, http(s)://host:port/path or exec:command, empty disables the watchdog"`
+	Interval         time.Duration `desc:"How often to run the watchdog check"`
+	Timeout          time.Duration `desc:"How long to wait for the watchdog check to finish"`
+	FailureThreshold int           `desc:"How many failed checks in a row deregister the target"`
+	SuccessThreshold int           `desc:"How many passed checks in a row register the deregistered target again"`
+	Command          string        `desc:"Command to execute when the watchdog deregisters or registers the target, WATCHDOG_STATE environment variable is set to deregistered or registered"`
+}
+
+// Checker checks health of the pod
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// execCheck passes when the command exits with zero
+type execCheck struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *execCheck) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "/bin/sh", "-c", e.Command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ParseCheck parses check in a form of tcp://host:port,
+// http(s)://host:port/path or exec:command
+func ParseCheck(check string, timeout time.Duration) (Checker, error) {
+	if strings.HasPrefix(check, execCheckPrefix) {
+		return &execCheck{Command: strings.TrimPrefix(check, execCheckPrefix), Timeout: timeout}, nil
+	}
+
+	u, err := url.Parse(check)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check %q: %v", check, err)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid check %q: %v", check, err)
+	}
+
+	healthCheck := &HealthCheck{
+		Address:          u.Host,
+		Path:             u.RequestURI(),
+		Matcher:          defaultHealthCheckMatcher,
+		HealthyThreshold: 1,
+		Timeout:          timeout,
+	}
+	switch u.Scheme {
+	case "tcp":
+		healthCheck.Protocol = elbv2.ProtocolEnumTcp
+	case "http":
+		healthCheck.Protocol = elbv2.ProtocolEnumHttp
+	case "https":
+		healthCheck.Protocol = elbv2.ProtocolEnumHttps
+	default:
+		return nil, fmt.Errorf("invalid check %q, expected tcp://, http://, https:// or exec:", check)
+	}
+	return healthCheck, nil
+}
+
+// RunWatchdog runs the watchdog check until ctx is cancelled. The target is
+// deregistered from all target groups after FailureThreshold failed checks
+// in a row and registered again after SuccessThreshold passed checks in a
+// row, which fences the pod faster than load balancer health checks.
+func RunWatchdog(ctx, shutdownCtx context.Context, app *App, bindings Bindings, registratorService *RegistratorService, lifecycle *Lifecycle, logger log.Logger) {
+	logger = log.With(logger, "check", app.Watchdog.Check)
+
+	checker, err := ParseCheck(app.Watchdog.Check, app.Watchdog.Timeout)
+	if err != nil {
+		level.Error(logger).Log("msg", "Not starting watchdog", "error", err)
+		return
+	}
+
+	ticker := time.NewTicker(app.Watchdog.Interval)
+	defer ticker.Stop()
+
+	logger.Log("msg", "Starting watchdog")
+	registered := true
+	failures, successes := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := checker.Check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			failures++
+			successes = 0
+			level.Warn(logger).Log("msg", "Watchdog check failed", "failures", failures, "error", err)
+		} else {
+			successes++
+			failures = 0
+		}
+
+		switch {
+		case registered && failures >= app.Watchdog.FailureThreshold:
+			logger.Log("msg", "Watchdog deregisters target", "failures", failures)
+			if err := lifecycle.Transition(StateDraining, nil); err != nil {
+				level.Warn(logger).Log("msg", "Watchdog can't deregister target", "error", err)
+				continue
+			}
+			if err := deregisterBindings(ctx, app, bindings, registratorService); err != nil {
+				// The target may still be registered, deregistration is
+				// tried again after the next failed check
+				lifecycle.Transition(StateFailed, err)
+				continue
+			}
+			lifecycle.Transition(StateDeregistered, nil)
+			registered = false
+			watchdogHook(ctx, app, watchdogStateDeregistered, logger)
+		case (!registered || lifecycle.State() == StateFailed) && successes >= app.Watchdog.SuccessThreshold:
+			logger.Log("msg", "Watchdog registers target again", "successes", successes)
+			if err := registerBindings(ctx, shutdownCtx, app, bindings, registratorService, lifecycle, logger); err != nil {
+				// Try again on the next passed check
+				continue
+			}
+			registered = true
+			watchdogHook(ctx, app, watchdogStateRegistered, logger)
+		}
+	}
+}
+
+func watchdogHook(ctx context.Context, app *App, state string, logger log.Logger) {
+	if app.Watchdog.Command == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, app.Watchdog.Timeout)
+	defer cancel()
+
+	logger.Log("msg", "Executing watchdog command", "command", app.Watchdog.Command, "state", state)
+	ExecCommand(ctx, logger, app.Watchdog.Command, constants.WatchdogStateEnv+"="+state)
+}